@@ -0,0 +1,104 @@
+package main
+
+/**
+检查一个数据库中root下的树是否完整、格式是否正确，检查内容见mpt/verifier.go
+目前只有内存数据库，所以数据库以文本导出的形式提供，每行一个key/value，都是hex编码，以空白分隔：
+	<hex key> <hex value>
+空行和#开头的行忽略。用法：
+	mptverify -root <hex root> [dump file]
+不指定文件时从标准输入读取。发现问题时逐条输出，退出码为1
+*/
+
+import (
+	"bufio"
+	"encoding/hex"
+	"ethereum-practice/mpt"
+	"ethereum-practice/mpt/database"
+	"flag"
+	"fmt"
+	"github.com/ethereum/go-ethereum/common"
+	"io"
+	"os"
+	"strings"
+)
+
+func main() {
+	rootFlag := flag.String("root", "", "hex encoded root hash to verify")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s -root <hash> [dump file]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	root, err := parseRoot(*rootFlag)
+	if err != nil {
+		fatalf("invalid root: %v", err)
+	}
+	in := os.Stdin
+	if flag.NArg() > 1 {
+		flag.Usage()
+		os.Exit(2)
+	} else if flag.NArg() == 1 {
+		if in, err = os.Open(flag.Arg(0)); err != nil {
+			fatalf("%v", err)
+		}
+		defer in.Close()
+	}
+	store, err := loadDump(in)
+	if err != nil {
+		fatalf("failed to load dump: %v", err)
+	}
+
+	result := mpt.Verify(store, root)
+	for _, v := range result.Violations {
+		fmt.Println(v)
+	}
+	fmt.Printf("checked %d stored nodes (%d bytes), %d embedded nodes, found %d violations\n",
+		result.Nodes, result.Bytes, result.Embedded, len(result.Violations))
+	if len(result.Violations) > 0 {
+		os.Exit(1)
+	}
+}
+
+func fatalf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	os.Exit(2)
+}
+
+func parseRoot(s string) (common.Hash, error) {
+	blob, err := hex.DecodeString(strings.TrimPrefix(s, "0x"))
+	if err != nil {
+		return common.Hash{}, err
+	}
+	if len(blob) != common.HashLength {
+		return common.Hash{}, fmt.Errorf("want %d bytes, have %d", common.HashLength, len(blob))
+	}
+	return common.BytesToHash(blob), nil
+}
+
+func loadDump(r io.Reader) (*database.MemoryDatabase, error) {
+	store := database.NewMemoryDatabase()
+	scanner := bufio.NewScanner(r)
+	// 一个满的branchNode编码大约530字节，hex之后也远小于这个上限，留足余量给大的value
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: want 2 fields, have %d", line, len(fields))
+		}
+		key, err := hex.DecodeString(strings.TrimPrefix(fields[0], "0x"))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid key: %v", line, err)
+		}
+		value, err := hex.DecodeString(strings.TrimPrefix(fields[1], "0x"))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid value: %v", line, err)
+		}
+		store.Put(key, value)
+	}
+	return store, scanner.Err()
+}
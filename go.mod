@@ -3,6 +3,8 @@ module ethereum-practice
 go 1.14
 
 require (
+	github.com/VictoriaMetrics/fastcache v1.5.7
 	github.com/ethereum/go-ethereum v1.9.24
+	github.com/steakknife/bloomfilter v0.0.0-20180922174646-6819c0d2a570
 	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
 )
@@ -0,0 +1,77 @@
+package mpt
+
+import (
+	"ethereum-practice/rlp"
+	"fmt"
+)
+
+/**
+持久化，对应源码的trie/committer.go
+Commit分两步：
+	1.先调用hasher把整棵树的哈希算好，每个节点的nodeStatus.hash都填上（嵌入节点除外）
+	2.再自底向上遍历dirty的节点，折叠后做rlp编码，以 keccak(rlp(node)) -> rlp(node) 的形式写入Database的dirties
+	  写完的子树用hashedNode替代，之后再访问时按需从数据库中解析
+	  dirties中的节点要等Database.Commit(root)才真正写入diskdb，见database_service.go
+非dirty的节点一定已经在数据库（dirties或diskdb）中了（它就是从数据库里解析出来的），直接用它的哈希值替代，不必重复写入
+*/
+
+type committer struct {
+	db  *Database
+	tmp sliceBuffer
+}
+
+func newCommitter(db *Database) *committer {
+	return &committer{db: db, tmp: make(sliceBuffer, 0, 550)}
+}
+
+// 返回值是折叠之后的节点：有哈希的返回hashedNode，嵌入节点返回折叠后的节点本身
+func (c *committer) commit(n node) (node, error) {
+	hash, dirty := n.cache()
+	if hash != nil && !dirty {
+		return hash, nil
+	}
+	switch cn := n.(type) {
+	case *shortNode:
+		collapsed := cn.copy()
+		collapsed.Key = hex2hpe(cn.Key)
+		// valueNode原样保留，其余类型的子节点递归处理
+		if _, ok := cn.Value.(valueNode); !ok {
+			child, err := c.commit(cn.Value)
+			if err != nil {
+				return nil, err
+			}
+			collapsed.Value = child
+		}
+		return c.store(collapsed, hash)
+	case *branchNode:
+		collapsed := cn.copy()
+		// 前16个为子树，第17个是valueNode，不需要处理
+		for i := 0; i < 16; i++ {
+			if child := cn.Children[i]; child != nil {
+				committed, err := c.commit(child)
+				if err != nil {
+					return nil, err
+				}
+				collapsed.Children[i] = committed
+			}
+		}
+		return c.store(collapsed, hash)
+	case hashedNode:
+		return cn, nil
+	default:
+		panic(fmt.Sprintf("errors occurs when committing node: %v", n))
+	}
+}
+
+// 写入数据库；没有哈希值的是嵌入节点，它会随父节点的编码一起保存，这里不单独写
+func (c *committer) store(n node, hash hashedNode) (node, error) {
+	if hash == nil {
+		return n, nil
+	}
+	c.tmp.Reset()
+	if err := rlp.Encode(&c.tmp, n); err != nil {
+		return nil, err
+	}
+	c.db.insert(hash, c.tmp, n)
+	return hash, nil
+}
@@ -0,0 +1,198 @@
+package mpt
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"github.com/ethereum/go-ethereum/common"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+/**
+ethereum/tests中TrieTests的用例，文件放在testdata/TrieTests下，说明见该目录的README.md
+*/
+
+// Mpt和SecureMpt共有的修改接口
+type conformanceTrie interface {
+	Insert(key, value []byte) error
+	Delete(key []byte) error
+	Hash() common.Hash
+}
+
+// 按顺序执行，value为null表示删除
+type orderedTest struct {
+	In   [][]*string `json:"in"`
+	Root string      `json:"root"`
+}
+
+// 任意顺序插入
+type anyOrderTest struct {
+	In   map[string]string `json:"in"`
+	Root string            `json:"root"`
+}
+
+type nextPrevTest struct {
+	In    []string    `json:"in"`
+	Tests [][3]string `json:"tests"`
+}
+
+// 文件不存在直接失败，不能因为少了用例文件就悄悄跳过
+func loadTrieTests(t *testing.T, name string, tests interface{}) {
+	blob, err := ioutil.ReadFile(filepath.Join("testdata", "TrieTests", name))
+	if os.IsNotExist(err) {
+		t.Fatalf("fixture %s missing, copy it from ethereum/tests TrieTests", name)
+	}
+	if err != nil {
+		t.Fatalf("failed to read %s: %v", name, err)
+	}
+	if err := json.Unmarshal(blob, tests); err != nil {
+		t.Fatalf("failed to parse %s: %v", name, err)
+	}
+}
+
+// "0x"开头的按hex解码，其余按原始字节
+func decodeFixture(t *testing.T, s string) []byte {
+	if strings.HasPrefix(s, "0x") {
+		b, err := hex.DecodeString(s[2:])
+		if err != nil {
+			t.Fatalf("invalid hex string %q: %v", s, err)
+		}
+		return b
+	}
+	return []byte(s)
+}
+
+func newConformanceTrie(secure bool) conformanceTrie {
+	if secure {
+		return newEmptySecure()
+	}
+	return newEmpty()
+}
+
+func runOrderedTests(t *testing.T, file string, secure bool) {
+	var tests map[string]orderedTest
+	loadTrieTests(t, file, &tests)
+	for name, test := range tests {
+		tr := newConformanceTrie(secure)
+		for _, kv := range test.In {
+			key := decodeFixture(t, *kv[0])
+			if kv[1] == nil {
+				if err := tr.Delete(key); err != nil {
+					t.Fatalf("%s: delete %x error: %v", name, key, err)
+				}
+			} else if err := tr.Insert(key, decodeFixture(t, *kv[1])); err != nil {
+				t.Fatalf("%s: insert %x error: %v", name, key, err)
+			}
+		}
+		if have, want := tr.Hash(), common.HexToHash(test.Root); have != want {
+			t.Errorf("%s: root mismatch, have %x want %x", name, have, want)
+		}
+	}
+}
+
+func runAnyOrderTests(t *testing.T, file string, secure bool) {
+	var tests map[string]anyOrderTest
+	loadTrieTests(t, file, &tests)
+	random := rand.New(rand.NewSource(1))
+	for name, test := range tests {
+		want := common.HexToHash(test.Root)
+		var keys []string
+		for k := range test.In {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		// 正序、倒序以及几种随机顺序
+		orders := [][]string{keys, make([]string, len(keys))}
+		for i, k := range keys {
+			orders[1][len(keys)-1-i] = k
+		}
+		for i := 0; i < 5; i++ {
+			shuffled := append([]string{}, keys...)
+			random.Shuffle(len(shuffled), func(i, j int) { shuffled[i], shuffled[j] = shuffled[j], shuffled[i] })
+			orders = append(orders, shuffled)
+		}
+		for i, order := range orders {
+			tr := newConformanceTrie(secure)
+			for _, k := range order {
+				if err := tr.Insert(decodeFixture(t, k), decodeFixture(t, test.In[k])); err != nil {
+					t.Fatalf("%s: insert %q error: %v", name, k, err)
+				}
+			}
+			if have := tr.Hash(); have != want {
+				t.Errorf("%s (order %d): root mismatch, have %x want %x", name, i, have, want)
+			}
+		}
+		if secure {
+			continue
+		}
+		// 批量修改同样要得到一致的结果
+		var batchKeys, batchValues [][]byte
+		for _, k := range keys {
+			batchKeys = append(batchKeys, decodeFixture(t, k))
+			batchValues = append(batchValues, decodeFixture(t, test.In[k]))
+		}
+		mpt := newEmpty()
+		if err := mpt.UpdateBatch(batchKeys, batchValues); err != nil {
+			t.Fatalf("%s: batch error: %v", name, err)
+		}
+		if have := mpt.Hash(); have != want {
+			t.Errorf("%s (batch): root mismatch, have %x want %x", name, have, want)
+		}
+	}
+}
+
+func TestTrieTestOrdered(t *testing.T) {
+	runOrderedTests(t, "trietest.json", false)
+}
+
+func TestTrieTestOrderedSecure(t *testing.T) {
+	runOrderedTests(t, "trietest_secureTrie.json", true)
+}
+
+func TestTrieTestAnyOrder(t *testing.T) {
+	runAnyOrderTests(t, "trieanyorder.json", false)
+}
+
+func TestTrieTestAnyOrderSecure(t *testing.T) {
+	runAnyOrderTests(t, "trieanyorder_secureTrie.json", true)
+}
+
+func TestTrieTestHexEncodedSecure(t *testing.T) {
+	runAnyOrderTests(t, "hex_encoded_securetrie_test.json", true)
+}
+
+// 对每个给定的key，前一个是树中小于它的最大key，后一个是大于它的最小key，不存在时为空串
+func TestTrieTestNextPrev(t *testing.T) {
+	var tests map[string]nextPrevTest
+	loadTrieTests(t, "trietestnextprev.json", &tests)
+	for name, test := range tests {
+		mpt := newEmpty()
+		for _, k := range test.In {
+			mpt.Insert(decodeFixture(t, k), decodeFixture(t, k))
+		}
+		for _, c := range test.Tests {
+			key := decodeFixture(t, c[0])
+			prev, next := "", ""
+			for it := mpt.ReverseIterator(key); it.Next(); {
+				if string(it.Key) != string(key) {
+					prev = string(it.Key)
+					break
+				}
+			}
+			for it := mpt.Iterator(key); it.Next(); {
+				if string(it.Key) != string(key) {
+					next = string(it.Key)
+					break
+				}
+			}
+			if prev != string(decodeFixture(t, c[1])) || next != string(decodeFixture(t, c[2])) {
+				t.Errorf("%s: key %q: have prev %q next %q, want prev %q next %q", name, c[0], prev, next, c[1], c[2])
+			}
+		}
+	}
+}
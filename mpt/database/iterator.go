@@ -0,0 +1,88 @@
+package database
+
+import (
+	"sort"
+	"strings"
+)
+
+/**
+对应源码ethdb.Iterator以及memorydb的迭代器
+按key的字典序遍历，剪枝等需要扫描整个存储的功能会用到
+*/
+
+type Iterator interface {
+	// 移动到下一个key/value，没有更多数据时返回false
+	Next() bool
+	Error() error
+	Key() []byte
+	Value() []byte
+	// 释放迭代器占用的资源，之后不能再使用
+	Release()
+}
+
+// 创建时对数据做一个快照，遍历过程中对数据库的修改（包括删除）不影响迭代器
+type memoryIterator struct {
+	inited bool
+	keys   []string
+	values [][]byte
+}
+
+// 遍历以prefix为前缀、不小于start的所有key，start不需要带prefix
+func (db *MemoryDatabase) NewIterator(prefix []byte, start []byte) Iterator {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	var (
+		pr     = string(prefix)
+		st     = string(append(append([]byte{}, prefix...), start...))
+		keys   = make([]string, 0, len(db.db))
+		values = make([][]byte, 0, len(db.db))
+	)
+	for key := range db.db {
+		if !strings.HasPrefix(key, pr) {
+			continue
+		}
+		if key >= st {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		values = append(values, db.db[key])
+	}
+	return &memoryIterator{keys: keys, values: values}
+}
+
+func (it *memoryIterator) Next() bool {
+	if !it.inited {
+		it.inited = true
+		return len(it.keys) > 0
+	}
+	if len(it.keys) > 0 {
+		it.keys = it.keys[1:]
+		it.values = it.values[1:]
+	}
+	return len(it.keys) > 0
+}
+
+func (it *memoryIterator) Error() error {
+	return nil
+}
+
+func (it *memoryIterator) Key() []byte {
+	if len(it.keys) > 0 {
+		return []byte(it.keys[0])
+	}
+	return nil
+}
+
+func (it *memoryIterator) Value() []byte {
+	if len(it.values) > 0 {
+		return it.values[0]
+	}
+	return nil
+}
+
+func (it *memoryIterator) Release() {
+	it.keys, it.values = nil, nil
+}
@@ -2,9 +2,11 @@ package mpt
 
 import (
 	"ethereum-practice/mpt/database"
+	"github.com/VictoriaMetrics/fastcache"
 	"github.com/ethereum/go-ethereum/common"
 	"io"
 	"sync"
+	"sync/atomic"
 )
 
 /**
@@ -15,6 +17,17 @@ import (
 （1）存：节点 -> 序列化 -> Put/Save
 （2）取：hashedKey -> Get -> 反序列化 -> 节点
 
+可选的clean缓存（对应源码trie.Database的cleans）：
+	缓存的是已经写入diskdb的节点的rlp编码，key为节点哈希。节点按内容寻址，同一个哈希永远对应同一份编码，
+	所以多棵树共用同一个Database时不存在缓存失效的问题，写入diskdb的同时顺手放进缓存即可
+	缓存的是编码而不是解码后的节点：解码出的节点会被Mpt修改（dirty），不能在多棵树之间共享
+
+dirty缓存与引用计数（对应源码trie.Database的dirties）：
+	Mpt.Commit写出的节点不直接落盘，而是先放在内存的dirties中，同时记录父节点 -> 子节点的引用计数
+	（1）Reference(child, parent)：增加一条引用，parent为空哈希时表示由外部（元根，meta-root）持有这棵树
+	（2）Dereference(root)：去掉元根对root的引用，引用计数归零的节点连同其子树一起从内存中删掉，根本不会写到磁盘上
+	（3）Commit(root)：把root下仍在dirties中的节点写入diskdb，并从dirties中移除（转入clean缓存）
+	过时的root只要及时Dereference，就不会让底层存储无限增长
 
 
 */
@@ -35,35 +48,320 @@ type KeyValueStore interface {
 	io.Closer
 }
 
+// 原像（preimage）在diskdb中的key前缀，与节点的key区分开，对应源码rawdb中的preimagePrefix
+var preimagePrefix = []byte("secure-key-")
+
+// Database的可选配置
+type Config struct {
+	Preimages bool // 是否记录SecureMpt中哈希key的原像
+	Cache     int  // clean缓存的大小，单位MB，0表示不开启缓存
+}
+
+// clean缓存的命中统计
+type CacheStats struct {
+	Hits   uint64
+	Misses uint64
+	Bytes  uint64 // 缓存中的编码占用的字节数
+}
+
 type Database struct {
 	diskdb KeyValueStore // Persistent storage for matured trie nodes
+	cleans *fastcache.Cache // 可选的clean节点缓存，nil表示不开启
+	dirties map[common.Hash]*cachedNode // 还没有落盘的节点，key为空哈希的是元根
+	dirtiesSize common.StorageSize // dirties中节点编码的总大小
+	preimages bool
+	preimageCache map[common.Hash][]byte // 还没有落盘的原像，与节点一起在Commit时写入diskdb
 	lock sync.RWMutex
+
+	cleanHits   uint64 // 原子操作
+	cleanMisses uint64 // 原子操作
 }
 
 func NewDatabase() *Database {
-	return &Database{diskdb:database.NewMemoryDatabase()}
+	return NewDatabaseWithStore(database.NewMemoryDatabase())
+}
+
+// 用已有的KeyValueStore构造，多个Database（进而多棵树）可以共用同一个底层存储
+func NewDatabaseWithStore(diskdb KeyValueStore) *Database {
+	return NewDatabaseWithConfig(diskdb, nil)
+}
+
+// config为nil时使用默认配置
+func NewDatabaseWithConfig(diskdb KeyValueStore, config *Config) *Database {
+	db := &Database{
+		diskdb:  diskdb,
+		dirties: map[common.Hash]*cachedNode{{}: {children: make(map[common.Hash]uint16)}},
+	}
+	if config != nil {
+		db.preimages = config.Preimages
+		if db.preimages {
+			db.preimageCache = make(map[common.Hash][]byte)
+		}
+		if config.Cache > 0 {
+			db.cleans = fastcache.New(config.Cache * 1024 * 1024)
+		}
+	}
+	return db
+}
+
+func (db *Database) DiskDB() KeyValueStore {
+	return db.diskdb
+}
+
+// 取节点的rlp编码：先查dirties，开启缓存时再查缓存，未命中再到diskdb中取并放入缓存
+// 节点不存在时返回nil, nil；读取出错（比如数据库已关闭）时返回error
+func (db *Database) node(hash common.Hash) ([]byte, error) {
+	db.lock.RLock()
+	dirty := db.dirties[hash]
+	db.lock.RUnlock()
+	if dirty != nil && hash != (common.Hash{}) {
+		return dirty.blob, nil
+	}
+	if db.cleans != nil {
+		if enc, ok := db.cleans.HasGet(nil, hash[:]); ok {
+			atomic.AddUint64(&db.cleanHits, 1)
+			return enc, nil
+		}
+		atomic.AddUint64(&db.cleanMisses, 1)
+	}
+	enc, err := db.diskdb.Get(hash[:])
+	if err != nil {
+		// 各种存储表示“不存在”的error各不相同，用Has区分开：确实没有这个key才算不存在
+		if has, herr := db.diskdb.Has(hash[:]); herr == nil && !has {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if len(enc) == 0 {
+		return nil, nil
+	}
+	if db.cleans != nil {
+		db.cleans.Set(hash[:], enc)
+	}
+	return enc, nil
+}
+
+// 未开启缓存时返回全0
+func (db *Database) CacheStats() CacheStats {
+	stats := CacheStats{
+		Hits:   atomic.LoadUint64(&db.cleanHits),
+		Misses: atomic.LoadUint64(&db.cleanMisses),
+	}
+	if db.cleans != nil {
+		var s fastcache.Stats
+		db.cleans.UpdateStats(&s)
+		stats.Bytes = s.BytesSize
+	}
+	return stats
+}
+
+// 根据hashed key取
+// 节点缺失或损坏时返回MissingNodeError/CorruptNodeError，不再吞掉错误
+func (db *Database) resolveHash(hash common.Hash) (node, error) {
+	return resolveHash(db, hash, nil)
+}
+
+// 存：hashedKey -> rlp编码的节点，先放进dirties，Commit时才落盘
+// collapsed是折叠后的节点，用来找出它引用的子节点，子节点还在dirties中的，引用计数加一
+func (db *Database) insert(hash hashedNode, blob []byte, collapsed node) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	key := common.BytesToHash(hash)
+	// 已经在dirties中的节点（同样内容的子树被多次提交）不重复计数
+	if _, ok := db.dirties[key]; ok {
+		return
+	}
+	entry := &cachedNode{blob: common.CopyBytes(blob)}
+	gatherChildren(collapsed, func(child common.Hash) {
+		entry.inner = append(entry.inner, child)
+		if c := db.dirties[child]; c != nil {
+			c.parents++
+		}
+	})
+	db.dirties[key] = entry
+	db.dirtiesSize += common.StorageSize(common.HashLength + len(entry.blob))
+}
+
+func preimageKey(hash common.Hash) []byte {
+	return append(append([]byte{}, preimagePrefix...), hash[:]...)
+}
+
+// 存：keccak(key) -> key，未开启原像记录时什么也不做
+// 与节点一样先放在内存中，Commit时才写入diskdb；原像不做引用计数，Dereference不会删掉它们，下次Commit时照样落盘
+func (db *Database) insertPreimage(hash common.Hash, preimage []byte) {
+	if !db.preimages {
+		return
+	}
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	db.preimageCache[hash] = common.CopyBytes(preimage)
 }
 
-// 根据hashed key取，无缓存情况下非常直接
-func (db *Database) resolveHash(hash common.Hash) node {
-	n, err := resolveHash(db, hash, nil)
+// 取：keccak(key) -> key，先查内存，再查diskdb，找不到时返回nil
+func (db *Database) preimage(hash common.Hash) []byte {
+	db.lock.RLock()
+	preimage := db.preimageCache[hash]
+	db.lock.RUnlock()
+	if preimage != nil {
+		return preimage
+	}
+	blob, err := db.diskdb.Get(preimageKey(hash))
 	if err != nil {
 		return nil
 	}
-	return n
+	return blob
+}
 
-	//encoded, err := db.diskdb.Get(hash[:])
-	//if err != nil || encoded == nil {
-	//	return nil
-	//}
-	//
-	//n, err := decodeNode(hash[:], encoded)
-	//if err != nil {
-	//	panic(fmt.Sprintf("node %x: %v", hash, err))
-	//}
-	//return n
+// dirties中的一个节点
+type cachedNode struct {
+	blob     []byte                 // 节点的rlp编码
+	inner    []common.Hash          // 编码中直接引用的子节点（hashedNode）
+	parents  uint32                 // 引用这个节点的存活节点数量
+	children map[common.Hash]uint16 // 通过Reference添加的外部引用，比如账户叶子引用的storage树的root
 }
 
+// 对节点中的每一个子节点（内部引用和外部引用）调用onChild
+func (n *cachedNode) forChildren(onChild func(hash common.Hash)) {
+	for child := range n.children {
+		onChild(child)
+	}
+	for _, child := range n.inner {
+		onChild(child)
+	}
+}
 
+// 遍历折叠后的节点，对其中的每一个hashedNode调用onChild，嵌入节点继续往下找
+func gatherChildren(n node, onChild func(hash common.Hash)) {
+	switch n := n.(type) {
+	case *shortNode:
+		gatherChildren(n.Value, onChild)
+	case *branchNode:
+		for i := 0; i < 16; i++ {
+			if n.Children[i] != nil {
+				gatherChildren(n.Children[i], onChild)
+			}
+		}
+	case hashedNode:
+		onChild(common.BytesToHash(n))
+	}
+}
 
+// 增加一条parent -> child的引用，parent为空哈希时表示由外部持有child这棵树
+// child不在dirties中（已经落盘）时什么也不做
+func (db *Database) Reference(child common.Hash, parent common.Hash) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
 
+	node, ok := db.dirties[child]
+	if !ok {
+		return
+	}
+	p, ok := db.dirties[parent]
+	if !ok {
+		return
+	}
+	if p.children == nil {
+		p.children = make(map[common.Hash]uint16)
+	} else if _, ok := p.children[child]; ok && parent != (common.Hash{}) {
+		// 同一个父节点对同一个子节点只计一次，元根除外（同一个root可能被持有多次）
+		return
+	}
+	node.parents++
+	p.children[child]++
+}
+
+// 去掉元根对root的一次引用，引用计数归零的节点及其子树从dirties中删除
+func (db *Database) Dereference(root common.Hash) {
+	if root == (common.Hash{}) {
+		return
+	}
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	db.dereference(root, common.Hash{})
+}
+
+func (db *Database) dereference(child common.Hash, parent common.Hash) {
+	if p := db.dirties[parent]; p != nil && p.children[child] > 0 {
+		p.children[child]--
+		if p.children[child] == 0 {
+			delete(p.children, child)
+		}
+	}
+	node, ok := db.dirties[child]
+	if !ok {
+		// 已经落盘的节点，不再管理
+		return
+	}
+	// 从磁盘解析出来的节点被修改后又恢复原样时，会以没有父节点的状态重新进入dirties，不能减成负数
+	if node.parents > 0 {
+		node.parents--
+	}
+	if node.parents == 0 {
+		delete(db.dirties, child)
+		db.dirtiesSize -= common.StorageSize(common.HashLength + len(node.blob))
+		node.forChildren(func(hash common.Hash) {
+			db.dereference(hash, child)
+		})
+	}
+}
+
+// 把root下所有仍在dirties中的节点写入diskdb，子节点先于父节点写入
+// 写入后从dirties中移除，开启clean缓存时转入缓存
+// 内存中的原像不属于哪一棵树，全部先写入
+func (db *Database) Commit(root common.Hash) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	for hash, preimage := range db.preimageCache {
+		if err := db.diskdb.Put(preimageKey(hash), preimage); err != nil {
+			return err
+		}
+		delete(db.preimageCache, hash)
+	}
+	return db.commit(root)
+}
+
+func (db *Database) commit(hash common.Hash) error {
+	node, ok := db.dirties[hash]
+	if !ok || hash == (common.Hash{}) {
+		return nil
+	}
+	var err error
+	node.forChildren(func(child common.Hash) {
+		if err == nil {
+			err = db.commit(child)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if err := db.diskdb.Put(hash[:], node.blob); err != nil {
+		return err
+	}
+	delete(db.dirties, hash)
+	db.dirtiesSize -= common.StorageSize(common.HashLength + len(node.blob))
+	if db.cleans != nil {
+		db.cleans.Set(hash[:], node.blob)
+	}
+	return nil
+}
+
+// dirties中节点的数量及编码占用的字节数（不含元根）
+func (db *Database) Size() (int, common.StorageSize) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	return len(db.dirties) - 1, db.dirtiesSize
+}
+
+// dirties中所有节点的哈希，开销很大，只用于测试
+func (db *Database) Nodes() []common.Hash {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	hashes := make([]common.Hash, 0, len(db.dirties))
+	for hash := range db.dirties {
+		if hash != (common.Hash{}) {
+			hashes = append(hashes, hash)
+		}
+	}
+	return hashes
+}
@@ -0,0 +1,21 @@
+//go:build go1.18
+// +build go1.18
+
+package mpt
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// testing.F从Go 1.18开始才有，单独放在这里，go.mod声明的旧版本工具链仍能编译其余的测试
+func FuzzDifferential(f *testing.F) {
+	for seed := int64(0); seed < 4; seed++ {
+		data := make([]byte, 300)
+		rand.New(rand.NewSource(seed)).Read(data)
+		f.Add(data)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		checkDiffOps(t, decodeDiffOps(data))
+	})
+}
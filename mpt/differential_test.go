@@ -0,0 +1,276 @@
+package mpt
+
+import (
+	"bytes"
+	"ethereum-practice/mpt/database"
+	"fmt"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/ethereum/go-ethereum/trie"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+/**
+差分测试：同一串操作同时作用于Mpt和源码的trie，每一步比较读出的value和根哈希，第一次出现不一致就报错
+报错时把操作序列缩减到仍能复现问题的最小序列（逐步删掉不影响结果的操作），方便直接写成用例
+同时提供fuzz入口（differential_fuzz_test.go，需要Go 1.18）：
+	go test -run xxx -fuzz FuzzDifferential -fuzzminimizetime 5x ./mpt
+（默认每个新输入都要花很长时间缩减，限制次数之后吞吐量高得多）
+生成的Insert中也有空value，两边都当成删除
+*/
+
+type diffOpKind int
+
+const (
+	diffInsert diffOpKind = iota
+	diffDelete
+	diffGet
+	diffHash
+	diffCommit // 提交，继续使用同一个Database
+	diffReopen // 提交并落盘，在新的Database上重新打开，之后的访问都要从磁盘解码
+	diffOpKinds
+)
+
+type diffOp struct {
+	kind       diffOpKind
+	key, value []byte
+}
+
+func (op diffOp) String() string {
+	switch op.kind {
+	case diffInsert:
+		return fmt.Sprintf("Insert(%x, %x)", op.key, op.value)
+	case diffDelete:
+		return fmt.Sprintf("Delete(%x)", op.key)
+	case diffGet:
+		return fmt.Sprintf("Get(%x)", op.key)
+	case diffHash:
+		return "Hash()"
+	case diffCommit:
+		return "Commit()"
+	default:
+		return "Reopen()"
+	}
+}
+
+func formatDiffOps(ops []diffOp) string {
+	lines := make([]string, len(ops))
+	for i, op := range ops {
+		lines[i] = fmt.Sprintf("\t%d: %v", i, op)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// 只用于测试缩减逻辑本身：不为nil时先改写Mpt一侧的Insert，人为制造不一致
+var diffMptFault func(op diffOp) diffOp
+
+// 两边的树以及各自的存储
+type diffTries struct {
+	mpt     *Mpt
+	diskdb  *database.MemoryDatabase
+	ref     *trie.Trie
+	refdb   *trie.Database
+	refDisk *memorydb.Database
+}
+
+func newDiffTries() *diffTries {
+	d := &diffTries{diskdb: database.NewMemoryDatabase(), refDisk: memorydb.New()}
+	d.mpt, _ = NewWithDatabase(common.Hash{}, NewDatabaseWithStore(d.diskdb))
+	d.refdb = trie.NewDatabase(d.refDisk)
+	d.ref, _ = trie.New(common.Hash{}, d.refdb)
+	return d
+}
+
+// 执行一个操作，两边结果不一致时返回错误
+func (d *diffTries) apply(op diffOp) error {
+	switch op.kind {
+	case diffInsert:
+		mptOp := op
+		if diffMptFault != nil {
+			mptOp = diffMptFault(op)
+		}
+		if err := d.mpt.Insert(mptOp.key, mptOp.value); err != nil {
+			return fmt.Errorf("mpt error: %v", err)
+		}
+		d.ref.Update(op.key, op.value)
+	case diffDelete:
+		if err := d.mpt.Delete(op.key); err != nil {
+			return fmt.Errorf("mpt error: %v", err)
+		}
+		d.ref.Delete(op.key)
+	case diffGet:
+		have, err := d.mpt.GetValue(op.key)
+		if err != nil {
+			return fmt.Errorf("mpt error: %v", err)
+		}
+		want, _ := d.ref.TryGet(op.key)
+		if !bytes.Equal(have, want) {
+			return fmt.Errorf("value mismatch: have %x want %x", have, want)
+		}
+	case diffHash:
+		if have, want := d.mpt.Hash(), d.ref.Hash(); have != want {
+			return fmt.Errorf("root mismatch: have %x want %x", have, want)
+		}
+	case diffCommit:
+		have, err := d.mpt.Commit()
+		if err != nil {
+			return fmt.Errorf("mpt error: %v", err)
+		}
+		want, _ := d.ref.Commit(nil)
+		if have != want {
+			return fmt.Errorf("commit root mismatch: have %x want %x", have, want)
+		}
+	case diffReopen:
+		have, err := d.mpt.Commit()
+		if err != nil {
+			return fmt.Errorf("mpt error: %v", err)
+		}
+		want, _ := d.ref.Commit(nil)
+		if have != want {
+			return fmt.Errorf("commit root mismatch: have %x want %x", have, want)
+		}
+		if err := d.mpt.Database().Commit(have); err != nil {
+			return fmt.Errorf("mpt error: %v", err)
+		}
+		d.refdb.Commit(want, false, nil)
+		if d.mpt, err = NewWithDatabase(have, NewDatabaseWithStore(d.diskdb)); err != nil {
+			return fmt.Errorf("mpt reopen error: %v", err)
+		}
+		d.refdb = trie.NewDatabase(d.refDisk)
+		d.ref, _ = trie.New(want, d.refdb)
+	}
+	return nil
+}
+
+// 依次执行，最后再比较一次根哈希；返回出错的位置和错误
+func runDiffOps(ops []diffOp) (int, error) {
+	d := newDiffTries()
+	for i, op := range ops {
+		if err := d.apply(op); err != nil {
+			return i, err
+		}
+	}
+	if err := d.apply(diffOp{kind: diffHash}); err != nil {
+		return len(ops), err
+	}
+	return -1, nil
+}
+
+// 缩减到仍然出错的最小序列：先截掉出错位置之后的操作，再反复尝试删掉一段/一个操作
+func minimizeDiffOps(ops []diffOp) []diffOp {
+	if at, err := runDiffOps(ops); err == nil {
+		return ops
+	} else if at < len(ops) {
+		ops = ops[:at+1]
+	}
+	for chunk := len(ops) / 2; chunk >= 1; chunk /= 2 {
+		for start := 0; start+chunk <= len(ops); {
+			candidate := append(append([]diffOp{}, ops[:start]...), ops[start+chunk:]...)
+			if _, err := runDiffOps(candidate); err != nil {
+				ops = candidate
+			} else {
+				start++
+			}
+		}
+	}
+	return ops
+}
+
+// 报告缩减之后的复现序列
+func checkDiffOps(t *testing.T, ops []diffOp) {
+	if _, err := runDiffOps(ops); err != nil {
+		minimal := minimizeDiffOps(ops)
+		at, err := runDiffOps(minimal)
+		t.Fatalf("divergence at step %d: %v\nminimal reproduction (%d of %d ops):\n%s", at, err, len(minimal), len(ops), formatDiffOps(minimal))
+	}
+}
+
+// key池：字母表很小、长度不一，大量共享前缀或互为前缀，删除时频繁触发branchNode的收缩
+func diffKeyPool(random *rand.Rand) [][]byte {
+	var pool [][]byte
+	for i := 0; i < 64; i++ {
+		key := make([]byte, random.Intn(5))
+		for j := range key {
+			key[j] = byte(random.Intn(4)) * 0x11
+		}
+		pool = append(pool, key)
+	}
+	return pool
+}
+
+func randomDiffOps(random *rand.Rand, n int) []diffOp {
+	pool := diffKeyPool(random)
+	ops := make([]diffOp, n)
+	for i := range ops {
+		op := diffOp{key: pool[random.Intn(len(pool))]}
+		switch r := random.Intn(100); {
+		case r < 45:
+			op.kind = diffInsert
+			// 长短不一的value，有嵌入节点也有哈希节点；偶尔为空，相当于删除
+			op.value = make([]byte, random.Intn(41))
+			random.Read(op.value)
+		case r < 75:
+			op.kind = diffDelete
+		case r < 90:
+			op.kind = diffGet
+		case r < 96:
+			op.kind = diffHash
+		case r < 98:
+			op.kind = diffCommit
+		default:
+			op.kind = diffReopen
+		}
+		ops[i] = op
+	}
+	return ops
+}
+
+// fuzz输入转成操作序列：每个操作占 1字节类型 + 1字节key + 1字节value长度
+func decodeDiffOps(data []byte) []diffOp {
+	var ops []diffOp
+	for ; len(data) >= 3; data = data[3:] {
+		op := diffOp{kind: diffOpKind(data[0]) % diffOpKinds}
+		// key长度0~3，每个nibble只取0~3
+		op.key = make([]byte, data[1]>>6)
+		for i := range op.key {
+			op.key[i] = (data[1] >> (2 * uint(i)) & 0x03) * 0x11
+		}
+		if op.kind == diffInsert {
+			// 长度为0时是删除
+			op.value = bytes.Repeat([]byte{data[2] | 1}, int(data[2]%41))
+		}
+		ops = append(ops, op)
+	}
+	return ops
+}
+
+func TestDifferential(t *testing.T) {
+	for seed := int64(0); seed < 50; seed++ {
+		checkDiffOps(t, randomDiffOps(rand.New(rand.NewSource(seed)), 1000))
+	}
+}
+
+// 缩减逻辑本身：Mpt一侧插入0x11时改掉value，人为制造一个一定会出错的序列，缩减之后只剩这一个Insert
+func TestDifferentialMinimize(t *testing.T) {
+	diffMptFault = func(op diffOp) diffOp {
+		if bytes.Equal(op.key, []byte{0x11}) && len(op.value) > 0 {
+			op.value = append(common.CopyBytes(op.value), 0xff)
+		}
+		return op
+	}
+	defer func() { diffMptFault = nil }()
+
+	random := rand.New(rand.NewSource(1))
+	ops := randomDiffOps(random, 200)
+	ops = append(ops, diffOp{kind: diffInsert, key: []byte{0x11}, value: []byte{1}})
+	ops = append(ops, randomDiffOps(random, 20)...)
+	minimal := minimizeDiffOps(ops)
+	if _, err := runDiffOps(minimal); err == nil {
+		t.Fatalf("minimized sequence no longer fails:\n%s", formatDiffOps(minimal))
+	}
+	if len(minimal) != 1 || minimal[0].kind != diffInsert || !bytes.Equal(minimal[0].key, []byte{0x11}) {
+		t.Fatalf("sequence not minimal (%d ops):\n%s", len(minimal), formatDiffOps(minimal))
+	}
+}
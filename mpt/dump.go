@@ -0,0 +1,243 @@
+package mpt
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+/**
+把树画出来，便于理解shortNode/branchNode/hashedNode的结构，以及调试delete之后的收缩
+两种格式：
+	DumpText：缩进的文本，每行一个节点，branchNode的子节点前面标出下标
+	DumpDOT：Graphviz的DOT格式，dot -Tsvg dump.dot > dump.svg
+节点标注类型、hex格式的key片段（不含判断位）、哈希的前4个字节（嵌入节点没有哈希，标为embedded）以及value
+只读：开始前对整棵树算一次哈希，得到带缓存的拷贝，之后直接读缓存，不修改树本身；hashedNode按需从数据库中解析
+可以只展开一部分：
+	MaxDepth：只展开深度（根节点为0）小于MaxDepth的节点，更深的子树折叠成一个节点
+	Key：只展开通往Key的路径，路径旁边的子树折叠成一个节点
+折叠的hashedNode不会去数据库中解析，只标出哈希
+*/
+
+type DumpFormat int
+
+const (
+	DumpText DumpFormat = iota
+	DumpDOT
+)
+
+var errDumpFormat = errors.New("unknown dump format")
+
+// value最多显示这么多字节，更长的截断
+const dumpValueBytes = 8
+
+type DumpConfig struct {
+	MaxDepth int    // 大于0时只展开深度小于MaxDepth的节点
+	Key      []byte // 不为nil时只展开通往这个key的路径
+}
+
+// 渲染之前先整理成与格式无关的结构
+type dumpItem struct {
+	kind     string // branch / extension / leaf / hashed
+	key      []byte // shortNode的key片段，hex格式，不含判断位
+	hash     []byte // 哈希，嵌入节点为nil
+	value    []byte
+	hasValue bool
+	folded   bool // 没有展开的子树
+	edges    []dumpEdge
+}
+
+type dumpEdge struct {
+	label string
+	item  *dumpItem
+}
+
+type dumper struct {
+	t      *Mpt
+	config *DumpConfig
+	hexKey []byte
+	w      io.Writer
+	err    error // 第一个写入错误
+	nextID int   // DOT中的节点编号
+}
+
+// config为nil时展开整棵树
+func (t *Mpt) Dump(w io.Writer, format DumpFormat, config *DumpConfig) error {
+	if format != DumpText && format != DumpDOT {
+		return errDumpFormat
+	}
+	if config == nil {
+		config = &DumpConfig{}
+	}
+	d := &dumper{t: t, config: config, w: w}
+	if config.Key != nil {
+		d.hexKey = key2hex(config.Key)
+	}
+	var root *dumpItem
+	if t.root != nil {
+		// 只算一次，每个节点的哈希都缓存在拷贝中；hashRoot不替换t.root
+		_, cached := t.hashRoot()
+		var err error
+		if root, err = d.build(cached, nil, 0); err != nil {
+			return err
+		}
+	}
+	if format == DumpText {
+		if root == nil {
+			d.printf("empty\n")
+		} else {
+			d.text(root, "", 0)
+		}
+	} else {
+		d.printf("digraph trie {\n\tnode [shape=box, fontname=\"monospace\"];\n")
+		if root == nil {
+			d.printf("\tn0 [label=\"empty\"];\n")
+		} else {
+			d.dot(root)
+		}
+		d.printf("}\n")
+	}
+	return d.err
+}
+
+func (d *dumper) printf(format string, args ...interface{}) {
+	if d.err == nil {
+		_, d.err = fmt.Fprintf(d.w, format, args...)
+	}
+}
+
+// path处深度为depth的节点是否展开
+func (d *dumper) expand(path []byte, depth int) bool {
+	if d.config.MaxDepth > 0 && depth >= d.config.MaxDepth {
+		return false
+	}
+	return d.hexKey == nil || bytes.HasPrefix(d.hexKey, path)
+}
+
+func (d *dumper) build(n node, path []byte, depth int) (*dumpItem, error) {
+	expand := d.expand(path, depth)
+	if hash, ok := n.(hashedNode); ok {
+		if !expand {
+			return &dumpItem{kind: "hashed", hash: hash, folded: true}, nil
+		}
+		resolved, err := d.t.resolveHashedNode(hash, path)
+		if err != nil {
+			return nil, err
+		}
+		n = resolved
+	}
+	// 哈希已经缓存在节点上（从数据库解析出来的节点本来就带着），嵌入节点没有哈希；根节点无论多小都有哈希
+	hash, _ := n.cache()
+	item := &dumpItem{hash: hash, folded: !expand}
+	switch n := n.(type) {
+	case *shortNode:
+		if isLeaf(n.Key) {
+			item.kind, item.key = "leaf", n.Key[:len(n.Key)-1]
+			item.value, _ = n.Value.(valueNode)
+			item.hasValue, item.folded = true, false
+			return item, nil
+		}
+		item.kind, item.key = "extension", n.Key
+		if expand && n.Value != nil {
+			child, err := d.build(n.Value, concat(path, n.Key), depth+1)
+			if err != nil {
+				return nil, err
+			}
+			item.edges = append(item.edges, dumpEdge{"", child})
+		}
+	case *branchNode:
+		item.kind = "branch"
+		if value, ok := n.Children[16].(valueNode); ok {
+			item.value, item.hasValue = value, true
+		}
+		if !expand {
+			break
+		}
+		for i := 0; i < 16; i++ {
+			if n.Children[i] == nil {
+				continue
+			}
+			child, err := d.build(n.Children[i], concat(path, []byte{byte(i)}), depth+1)
+			if err != nil {
+				return nil, err
+			}
+			item.edges = append(item.edges, dumpEdge{fmt.Sprintf("%x", i), child})
+		}
+	default:
+		return nil, fmt.Errorf("unexpected node type %T at path %x", n, path)
+	}
+	return item, nil
+}
+
+// key片段，每个nibble一个hex字符
+func formatNibbles(nibbles []byte) string {
+	var b strings.Builder
+	for _, n := range nibbles {
+		fmt.Fprintf(&b, "%x", n)
+	}
+	return b.String()
+}
+
+// 节点的各项描述，文本格式用空格连接，DOT格式每项一行
+func (item *dumpItem) describe() []string {
+	parts := []string{item.kind}
+	if item.kind == "leaf" || item.kind == "extension" {
+		if len(item.key) == 0 {
+			// 叶子节点的key只剩判断位
+			parts = append(parts, "key=-")
+		} else {
+			parts = append(parts, "key="+formatNibbles(item.key))
+		}
+	}
+	if item.hash != nil {
+		parts = append(parts, fmt.Sprintf("%x", item.hash[:4]))
+	} else {
+		parts = append(parts, "embedded")
+	}
+	if item.hasValue {
+		if len(item.value) > dumpValueBytes {
+			parts = append(parts, fmt.Sprintf("value=%x...(%d bytes)", item.value[:dumpValueBytes], len(item.value)))
+		} else {
+			parts = append(parts, fmt.Sprintf("value=%x", item.value))
+		}
+	}
+	if item.folded {
+		parts = append(parts, "...")
+	}
+	return parts
+}
+
+func (d *dumper) text(item *dumpItem, label string, indent int) {
+	if label != "" {
+		label = "[" + label + "] "
+	}
+	d.printf("%s%s%s\n", strings.Repeat("  ", indent), label, strings.Join(item.describe(), " "))
+	for _, edge := range item.edges {
+		d.text(edge.item, edge.label, indent+1)
+	}
+}
+
+// 返回节点在DOT中的编号
+func (d *dumper) dot(item *dumpItem) int {
+	id := d.nextID
+	d.nextID++
+	attrs := ""
+	switch {
+	case item.folded:
+		attrs = ", style=dashed"
+	case item.hash == nil:
+		attrs = ", style=rounded"
+	}
+	d.printf("\tn%d [label=\"%s\"%s];\n", id, strings.Join(item.describe(), "\\n"), attrs)
+	for _, edge := range item.edges {
+		child := d.dot(edge.item)
+		if edge.label != "" {
+			d.printf("\tn%d -> n%d [label=\"%s\"];\n", id, child, edge.label)
+		} else {
+			d.printf("\tn%d -> n%d;\n", id, child)
+		}
+	}
+	return id
+}
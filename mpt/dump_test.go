@@ -0,0 +1,135 @@
+package mpt
+
+import (
+	"bytes"
+	"ethereum-practice/mpt/database"
+	"strings"
+	"testing"
+)
+
+func dumpString(t *testing.T, mpt *Mpt, format DumpFormat, config *DumpConfig) string {
+	var b strings.Builder
+	if err := mpt.Dump(&b, format, config); err != nil {
+		t.Fatalf("dump error: %v", err)
+	}
+	return b.String()
+}
+
+func TestDump(t *testing.T) {
+	tests := []struct {
+		config *DumpConfig
+		want   string
+	}{
+		{nil, `branch 19f0ff4e value=0000000000000000...(40 bytes)
+  [0] branch 404fbe2e
+    [0] leaf key=- fe6bb691 value=0101010101010101...(41 bytes)
+    [1] leaf key=- aec7d21c value=0202020202020202...(42 bytes)
+  [1] leaf key=0 f8915567 value=0303030303030303...(43 bytes)
+  [2] leaf key=0 embedded value=78
+  [3] extension key=00 53f5e8e8
+    branch f95652bd
+      [0] leaf key=- 70c1dbef value=0505050505050505...(45 bytes)
+      [1] leaf key=- b04d50a4 value=0606060606060606...(46 bytes)
+`},
+		{&DumpConfig{MaxDepth: 2}, `branch 19f0ff4e value=0000000000000000...(40 bytes)
+  [0] branch 404fbe2e
+    [0] leaf key=- fe6bb691 value=0101010101010101...(41 bytes)
+    [1] leaf key=- aec7d21c value=0202020202020202...(42 bytes)
+  [1] leaf key=0 f8915567 value=0303030303030303...(43 bytes)
+  [2] leaf key=0 embedded value=78
+  [3] extension key=00 53f5e8e8
+    branch f95652bd ...
+`},
+		{&DumpConfig{Key: []byte{0x30, 0x01}}, `branch 19f0ff4e value=0000000000000000...(40 bytes)
+  [0] branch 404fbe2e ...
+  [1] leaf key=0 f8915567 value=0303030303030303...(43 bytes)
+  [2] leaf key=0 embedded value=78
+  [3] extension key=00 53f5e8e8
+    branch f95652bd
+      [0] leaf key=- 70c1dbef value=0505050505050505...(45 bytes)
+      [1] leaf key=- b04d50a4 value=0606060606060606...(46 bytes)
+`},
+	}
+	mpt := shapeTestTrie()
+	for i, test := range tests {
+		if have := dumpString(t, mpt, DumpText, test.config); have != test.want {
+			t.Errorf("test %d: have\n%s\nwant\n%s", i, have, test.want)
+		}
+	}
+	// Dump不修改树，之后计算出的哈希与根节点的标注一致
+	if root := mpt.Hash(); !strings.HasPrefix(root.Hex(), "0x19f0ff4e") {
+		t.Errorf("root hash %x does not match dump", root)
+	}
+	if have := dumpString(t, newEmpty(), DumpText, nil); have != "empty\n" {
+		t.Errorf("empty trie: have %q", have)
+	}
+}
+
+// 从数据库中解析出来的树画出来是一样的，折叠的部分不需要解析
+func TestDumpCommitted(t *testing.T) {
+	mpt := shapeTestTrie()
+	want := dumpString(t, mpt, DumpText, nil)
+
+	diskdb := database.NewMemoryDatabase()
+	root := commitToStore(t, diskdb, mpt.root)
+	reopened, _ := NewWithDatabase(root, NewDatabaseWithStore(diskdb))
+	if have := dumpString(t, reopened, DumpText, nil); have != want {
+		t.Errorf("reopened trie: have\n%s\nwant\n%s", have, want)
+	}
+	folded := dumpString(t, reopened, DumpText, &DumpConfig{MaxDepth: 1})
+	if !strings.Contains(folded, "[0] hashed 404fbe2e ...\n") {
+		t.Errorf("folded hashed node not shown:\n%s", folded)
+	}
+
+	// 缺失的节点只有在展开时才报错
+	reopened, _ = NewWithDatabase(root, NewDatabaseWithStore(diskdb))
+	for it := reopened.NodeIterator(nil); it.Next(true); {
+		if bytes.Equal(it.Path(), []byte{0}) {
+			hash := it.Hash()
+			diskdb.Delete(hash[:])
+			break
+		}
+	}
+	if err := reopened.Dump(&strings.Builder{}, DumpText, &DumpConfig{Key: []byte{0x30, 0x01}}); err != nil {
+		t.Errorf("folded missing node reported: %v", err)
+	}
+	if err := reopened.Dump(&strings.Builder{}, DumpText, nil); err == nil {
+		t.Errorf("no error for missing node")
+	} else if _, ok := err.(*MissingNodeError); !ok {
+		t.Errorf("unexpected error type %T: %v", err, err)
+	}
+}
+
+func TestDumpDOT(t *testing.T) {
+	have := dumpString(t, shapeTestTrie(), DumpDOT, &DumpConfig{MaxDepth: 2})
+	if !strings.HasPrefix(have, "digraph trie {\n") || !strings.HasSuffix(have, "}\n") {
+		t.Fatalf("malformed DOT output:\n%s", have)
+	}
+	// 8个节点，7条边
+	nodes, edges := 0, 0
+	for _, line := range strings.Split(have, "\n") {
+		switch {
+		case strings.Contains(line, " -> "):
+			edges++
+		case strings.HasPrefix(line, "\tn") && strings.Contains(line, " [label="):
+			nodes++
+		}
+	}
+	if nodes != 8 || edges != 7 {
+		t.Errorf("have %d nodes and %d edges:\n%s", nodes, edges, have)
+	}
+	for _, want := range []string{
+		"n0 [label=\"branch\\n19f0ff4e\\nvalue=0000000000000000...(40 bytes)\"];",
+		"[label=\"leaf\\nkey=0\\nembedded\\nvalue=78\", style=rounded];",
+		"[label=\"branch\\nf95652bd\\n...\", style=dashed];",
+		"n0 -> n6 [label=\"3\"];",
+		"n6 -> n7;",
+	} {
+		if !strings.Contains(have, want) {
+			t.Errorf("missing %q in:\n%s", want, have)
+		}
+	}
+	if err := shapeTestTrie().Dump(&strings.Builder{}, DumpFormat(-1), nil); err != errDumpFormat {
+		t.Errorf("unexpected error for unknown format: %v", err)
+	}
+}
@@ -0,0 +1,35 @@
+package mpt
+
+import (
+	"fmt"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+/**
+错误类型，对应源码的trie/errors.go
+区分两种数据库问题，调用方可以据此判断是“key不存在”还是“数据库不完整/损坏”：
+	MissingNodeError：按哈希在数据库中找不到节点（数据库不完整，或者root本身就不存在）
+	CorruptNodeError：节点找到了，但是解码失败（数据库损坏）
+Path是从根节点到出问题的节点的hex路径，即各个resolver携带的prefix
+读取本身出错（比如数据库已关闭、I/O错误）不属于这两种，底层的error会被包装之后原样返回，可以用errors.Is/As取出
+*/
+
+type MissingNodeError struct {
+	NodeHash common.Hash // 缺失节点的哈希
+	Path     []byte      // 缺失节点的hex路径
+}
+
+func (err *MissingNodeError) Error() string {
+	return fmt.Sprintf("missing trie node %x (path %x)", err.NodeHash, err.Path)
+}
+
+type CorruptNodeError struct {
+	NodeHash common.Hash // 损坏节点的哈希
+	Path     []byte      // 损坏节点的hex路径
+	Blob     []byte      // 数据库中保存的原始内容
+	Err      error       // 解码时的错误
+}
+
+func (err *CorruptNodeError) Error() string {
+	return fmt.Sprintf("corrupt trie node %x (path %x): %v", err.NodeHash, err.Path, err.Err)
+}
@@ -0,0 +1,167 @@
+package mpt
+
+import (
+	"ethereum-practice/rlp"
+	"fmt"
+	"github.com/ethereum/go-ethereum/crypto"
+	"golang.org/x/crypto/sha3"
+	"sync"
+)
+
+/**
+哈希计算，对应源码的trie/hasher.go
+计算规则：
+	1.自底向上，先把子节点“折叠”（collapse），再对当前节点做rlp编码，最后做keccak256
+	2.折叠的含义：shortNode的Key从hex转成hpe；子节点替换成其hashedNode，或者嵌入节点本身
+	3.嵌入节点：rlp编码小于32byte的节点不做哈希，直接放在父节点中；根节点例外，无论多小都要做哈希（force）
+每次计算返回两个节点：
+	hashed：折叠之后的结果，用于父节点的编码，可能是hashedNode，也可能是嵌入的节点
+	cached：原节点的拷贝，nodeStatus.hash填上了计算结果，替换原树中的节点，下次计算直接用缓存
+并行计算：
+	大批量修改之后，大部分时间花在上层branchNode的16个子树上。parallel为true时，对第一个遇到的branchNode，
+	16个子树分别交给16个goroutine（各用一个非并行的hasher）计算，更深的节点仍然是单线程
+	每个子树的计算互不依赖，结果写回各自的下标，与顺序计算完全一致
+	是否并行由Mpt根据需要重新计算的节点数决定（见parallelHashThreshold、countDirty），修改很少时开goroutine得不偿失
+*/
+
+type sliceBuffer []byte
+
+func (b *sliceBuffer) Write(data []byte) (n int, err error) {
+	*b = append(*b, data...)
+	return len(data), nil
+}
+
+func (b *sliceBuffer) Reset() {
+	*b = (*b)[:0]
+}
+
+type hasher struct {
+	sha      crypto.KeccakState
+	tmp      sliceBuffer
+	parallel bool // 是否并行计算branchNode的子树
+}
+
+// hasher会被频繁创建，用pool复用临时空间
+var hasherPool = sync.Pool{
+	New: func() interface{} {
+		return &hasher{
+			tmp: make(sliceBuffer, 0, 550), // 一个满的branchNode大约这么大
+			sha: sha3.NewLegacyKeccak256().(crypto.KeccakState),
+		}
+	},
+}
+
+func newHasher(parallel bool) *hasher {
+	h := hasherPool.Get().(*hasher)
+	h.parallel = parallel
+	return h
+}
+
+func returnHasherToPool(h *hasher) {
+	hasherPool.Put(h)
+}
+
+// force为true时，即使编码不足32byte也做哈希（用于根节点）
+func (h *hasher) hash(n node, force bool) (hashed node, cached node) {
+	// 有缓存直接返回
+	if hash, _ := n.cache(); hash != nil {
+		return hash, n
+	}
+	switch n := n.(type) {
+	case *shortNode:
+		collapsed, cached := h.hashShortNodeChildren(n)
+		hashed := h.encodeAndHash(collapsed, force)
+		// 嵌入节点没有哈希值，不能缓存
+		if hn, ok := hashed.(hashedNode); ok {
+			cached.status.hash = hn
+		} else {
+			cached.status.hash = nil
+		}
+		return hashed, cached
+	case *branchNode:
+		collapsed, cached := h.hashBranchNodeChildren(n)
+		hashed := h.encodeAndHash(collapsed, force)
+		if hn, ok := hashed.(hashedNode); ok {
+			cached.status.hash = hn
+		} else {
+			cached.status.hash = nil
+		}
+		return hashed, cached
+	default:
+		// valueNode和hashedNode没有子节点，原样返回
+		return n, n
+	}
+}
+
+// 折叠shortNode：Key转成hpe，子节点（如果是shortNode/branchNode）递归计算哈希
+func (h *hasher) hashShortNodeChildren(n *shortNode) (collapsed, cached *shortNode) {
+	collapsed, cached = n.copy(), n.copy()
+	collapsed.Key = hex2hpe(n.Key)
+	switch n.Value.(type) {
+	case *shortNode, *branchNode:
+		collapsed.Value, cached.Value = h.hash(n.Value, false)
+	}
+	return collapsed, cached
+}
+
+// 折叠branchNode：前16个子节点递归计算哈希，第17个是valueNode，保持原样
+func (h *hasher) hashBranchNodeChildren(n *branchNode) (collapsed, cached *branchNode) {
+	collapsed, cached = n.copy(), n.copy()
+	if h.parallel {
+		var wg sync.WaitGroup
+		for i := 0; i < 16; i++ {
+			if child := n.Children[i]; child != nil {
+				wg.Add(1)
+				go func(i int, child node) {
+					hasher := newHasher(false)
+					collapsed.Children[i], cached.Children[i] = hasher.hash(child, false)
+					returnHasherToPool(hasher)
+					wg.Done()
+				}(i, child)
+			}
+		}
+		wg.Wait()
+		return collapsed, cached
+	}
+	for i := 0; i < 16; i++ {
+		if child := n.Children[i]; child != nil {
+			collapsed.Children[i], cached.Children[i] = h.hash(child, false)
+		}
+	}
+	return collapsed, cached
+}
+
+// 对折叠后的节点做rlp编码，小于32byte且不强制哈希时返回节点本身（嵌入节点）
+func (h *hasher) encodeAndHash(n node, force bool) node {
+	h.tmp.Reset()
+	if err := rlp.Encode(&h.tmp, n); err != nil {
+		panic(fmt.Sprintf("encode error: %v", err))
+	}
+	if len(h.tmp) < 32 && !force {
+		return n
+	}
+	return h.hashData(h.tmp)
+}
+
+func (h *hasher) hashData(data []byte) hashedNode {
+	n := make(hashedNode, 32)
+	h.sha.Reset()
+	h.sha.Write(data)
+	h.sha.Read(n)
+	return n
+}
+
+// 只折叠不缓存，返回折叠后的节点（用于rlp编码）以及其哈希值（嵌入节点返回节点本身）
+// 用于GetNode和Prove这类只读操作，不会修改原树
+func (h *hasher) proofHash(original node) (collapsed, hashed node) {
+	switch n := original.(type) {
+	case *shortNode:
+		sn, _ := h.hashShortNodeChildren(n)
+		return sn, h.encodeAndHash(sn, false)
+	case *branchNode:
+		bn, _ := h.hashBranchNodeChildren(n)
+		return bn, h.encodeAndHash(bn, false)
+	default:
+		return n, n
+	}
+}
@@ -0,0 +1,108 @@
+package mpt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/ethereum/go-ethereum/crypto"
+	"testing"
+)
+
+func benchTrie(n int) *Mpt {
+	mpt := newEmpty()
+	key := make([]byte, 8)
+	for i := 0; i < n; i++ {
+		binary.BigEndian.PutUint64(key, uint64(i))
+		hashed := crypto.Keccak256(key)
+		mpt.Insert(hashed, hashed)
+	}
+	return mpt
+}
+
+// 并行与顺序计算的结果（包括缓存到各个节点上的哈希）必须完全一致
+func TestParallelHash(t *testing.T) {
+	for _, n := range []int{1, 16, 17, 1000, 5000} {
+		mpt := benchTrie(n)
+
+		seq := newHasher(false)
+		seqHash, seqCached := seq.hash(mpt.root, true)
+		returnHasherToPool(seq)
+
+		par := newHasher(true)
+		parHash, parCached := par.hash(mpt.root, true)
+		returnHasherToPool(par)
+
+		if !bytes.Equal(seqHash.(hashedNode), parHash.(hashedNode)) {
+			t.Fatalf("n=%d: root mismatch: sequential %x, parallel %x", n, seqHash, parHash)
+		}
+		if a, b := nodeHashes(&Mpt{root: seqCached}), nodeHashes(&Mpt{root: parCached}); len(a) != len(b) {
+			t.Fatalf("n=%d: cached node count mismatch: sequential %d, parallel %d", n, len(a), len(b))
+		} else {
+			for hash := range a {
+				if _, ok := b[hash]; !ok {
+					t.Fatalf("n=%d: cached node %x missing in parallel result", n, hash)
+				}
+			}
+		}
+	}
+	// 需要计算的节点超过阈值时Mpt.Hash走并行分支，结果与逐个计算一致
+	mpt := benchTrie(parallelHashThreshold * 2)
+	if dirty := countDirty(mpt.root, parallelHashThreshold); dirty != parallelHashThreshold {
+		t.Fatalf("expected at least %d dirty nodes, counted %d", parallelHashThreshold, dirty)
+	}
+	want := benchTrie(0)
+	key := make([]byte, 8)
+	for i := 0; i < parallelHashThreshold*2; i++ {
+		binary.BigEndian.PutUint64(key, uint64(i))
+		hashed := crypto.Keccak256(key)
+		want.Insert(hashed, hashed)
+		want.Hash()
+	}
+	if have, want := mpt.Hash(), want.Hash(); have != want {
+		t.Fatalf("root mismatch: have %x want %x", have, want)
+	}
+	if dirty := countDirty(mpt.root, parallelHashThreshold); dirty != 0 {
+		t.Fatalf("%d dirty nodes left after hashing", dirty)
+	}
+}
+
+// 数的是没有哈希缓存的节点，而不是修改的次数，回滚快照之后跟着旧树走
+func TestCountDirty(t *testing.T) {
+	mpt := benchTrie(1000)
+	all := countDirty(mpt.root, 1<<30)
+	if nodes := len(nodeHashes(mpt.Copy())); all < nodes {
+		t.Fatalf("counted %d dirty nodes, trie has %d hashed nodes", all, nodes)
+	}
+	id := mpt.Snapshot()
+	mpt.Hash()
+	// 一次修改只弄脏路径上的几个节点
+	mpt.Insert([]byte("key"), []byte("value"))
+	if dirty := countDirty(mpt.root, 1<<30); dirty == 0 || dirty > 10 {
+		t.Fatalf("single insert: counted %d dirty nodes", dirty)
+	}
+	mpt.RevertToSnapshot(id)
+	if dirty := countDirty(mpt.root, 1<<30); dirty != all {
+		t.Fatalf("after revert: counted %d dirty nodes, want %d", dirty, all)
+	}
+}
+
+func BenchmarkHash100k(b *testing.B) { benchmarkHash(b, 100000) }
+func BenchmarkHash1M(b *testing.B)   { benchmarkHash(b, 1000000) }
+
+// 树在计时之外构造好；节点不可变，hash不修改原树，同一棵未缓存哈希的树可以反复计算，每轮都是完整的一次计算
+func benchmarkHash(b *testing.B, n int) {
+	mpt := benchTrie(n)
+	for _, parallel := range []bool{false, true} {
+		name := "sequential"
+		if parallel {
+			name = "parallel"
+		}
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				h := newHasher(parallel)
+				h.hash(mpt.root, true)
+				returnHasherToPool(h)
+			}
+		})
+	}
+}
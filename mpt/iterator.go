@@ -0,0 +1,475 @@
+package mpt
+
+import (
+	"bytes"
+	"errors"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+/**
+节点迭代器，对应源码的trie/iterator.go
+按先序遍历（pre-order）访问树中的每一个节点，子节点按nibble从小到大访问，因此叶子是按key的字典序出现的
+实现方式：
+	用一个栈记录从根到当前节点的路径，栈中每一项记录节点本身、它的哈希、下一个要访问的子节点下标
+	Next时从栈顶节点找下一个子节点，找不到就出栈回到父节点，直到栈空
+	遇到hashedNode时才到数据库中解析（懒加载），不会预先把整棵树读进内存
+路径（Path）是hex编码，叶子节点（valueNode）的路径以判断位0x10结尾
+与源码不同的一点：branchNode的value（第17个子节点）最先访问。它对应的key是所有子节点key的前缀，按字节序最小，
+这样叶子出现的顺序与原始key的字节序严格一致；路径之间的比较相应地用compareHexPath，判断位排在所有nibble之前
+反向迭代时子节点从大到小访问，value最后访问，叶子按key从大到小出现（父节点仍然先于子节点访问）
+
+在节点迭代器之上，Iterator只关心叶子，按字节序（或者反序）给出(key, value)
+*/
+
+// 按字节序迭代(key, value)
+type Iterator struct {
+	trie    *Mpt
+	nodeIt  NodeIterator
+	reverse bool
+	bound   []byte // 反向迭代的起点（hex编码），key大于它的子树直接跳过
+
+	Key   []byte // 当前的key
+	Value []byte // 当前的value，原样返回，如有编码由调用方自行解码
+	Err   error
+}
+
+// 包装任意一个节点迭代器，只取其中的叶子
+func NewIterator(it NodeIterator) *Iterator {
+	return &Iterator{nodeIt: it}
+}
+
+// 从start开始（包含start）按key从小到大迭代，start为nil时从最小的key开始
+func (t *Mpt) Iterator(start []byte) *Iterator {
+	return &Iterator{trie: t, nodeIt: newNodeIterator(t, start, false)}
+}
+
+// 从start开始（包含start）按key从大到小迭代，start为nil时从最大的key开始
+func (t *Mpt) ReverseIterator(start []byte) *Iterator {
+	it := &Iterator{trie: t, nodeIt: newNodeIterator(t, nil, true), reverse: true}
+	if start != nil {
+		it.bound = key2hex(start)
+	}
+	return it
+}
+
+// 重新定位到key：正向迭代时下一个是不小于key的最小key，反向迭代时下一个是不大于key的最大key
+func (it *Iterator) Seek(key []byte) {
+	if it.trie == nil {
+		it.Err = errors.New("seek is not supported by a wrapped node iterator")
+		return
+	}
+	if it.reverse {
+		*it = *it.trie.ReverseIterator(key)
+	} else {
+		*it = *it.trie.Iterator(key)
+	}
+}
+
+func (it *Iterator) Next() bool {
+	descend := true
+	for it.nodeIt.Next(descend) {
+		descend = true
+		path := it.nodeIt.Path()
+		// 反向迭代时，整棵子树的key都大于起点的，直接跳过
+		if it.bound != nil && !bytes.HasPrefix(it.bound, path) && compareHexPath(path, it.bound) > 0 {
+			descend = false
+			continue
+		}
+		if it.nodeIt.Leaf() {
+			it.Key = it.nodeIt.LeafKey()
+			it.Value = it.nodeIt.LeafBlob()
+			return true
+		}
+	}
+	it.Key = nil
+	it.Value = nil
+	it.Err = it.nodeIt.Error()
+	return false
+}
+
+// branchNode子节点的访问顺序
+var (
+	forwardOrder = [17]int{16, 0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+	reverseOrder = [17]int{15, 14, 13, 12, 11, 10, 9, 8, 7, 6, 5, 4, 3, 2, 1, 0, 16}
+)
+
+type NodeIterator interface {
+	// 移动到下一个节点，descend为false时跳过当前节点的所有子节点
+	Next(descend bool) bool
+
+	// 迭代过程中遇到的错误
+	Error() error
+
+	// 当前节点的哈希，嵌入节点和valueNode没有哈希，返回空哈希
+	Hash() common.Hash
+
+	// 最近一个有哈希的祖先节点的哈希，根节点返回空哈希
+	Parent() common.Hash
+
+	// 当前节点的hex路径，调用Next之后不能再引用返回值
+	Path() []byte
+
+	// 当前节点是否为叶子（valueNode）
+	Leaf() bool
+
+	// 叶子的原始key，不在叶子上时panic
+	LeafKey() []byte
+
+	// 叶子的value，不在叶子上时panic
+	LeafBlob() []byte
+}
+
+// 栈中的一项，记录某个节点的迭代状态
+type nodeIteratorState struct {
+	hash    common.Hash // 节点的哈希（嵌入节点为空）
+	node    node        // 节点本身
+	parent  common.Hash // 最近一个有哈希的祖先节点的哈希
+	index   int         // 已经访问到的子节点在访问顺序中的位置
+	pathlen int         // 到达该节点时路径的长度
+}
+
+type nodeIterator struct {
+	trie  *Mpt
+	stack []*nodeIteratorState
+	path  []byte  // 当前节点的路径
+	order [17]int // branchNode子节点的访问顺序
+	err   error
+}
+
+// 迭代结束时记录在nodeIterator.err中
+var errIteratorEnd = errors.New("end of iteration")
+
+// 初始定位失败时记录在nodeIterator.err中，下一次Next时重试
+type seekError struct {
+	key []byte
+	err error
+}
+
+func (e seekError) Error() string {
+	return "seek error: " + e.err.Error()
+}
+
+// 从start开始迭代，跳过路径小于start的所有节点；start为nil时从头开始
+func (t *Mpt) NodeIterator(start []byte) NodeIterator {
+	return newNodeIterator(t, start, false)
+}
+
+// 反向迭代不支持start，由上层的Iterator负责跳过
+func newNodeIterator(t *Mpt, start []byte, reverse bool) *nodeIterator {
+	it := &nodeIterator{trie: t, order: forwardOrder}
+	if reverse {
+		it.order = reverseOrder
+	}
+	if t.Hash() == EmptyRoot {
+		it.err = errIteratorEnd
+		return it
+	}
+	if !reverse {
+		it.err = it.seek(start)
+	}
+	return it
+}
+
+func (it *nodeIterator) Hash() common.Hash {
+	if len(it.stack) == 0 {
+		return common.Hash{}
+	}
+	return it.stack[len(it.stack)-1].hash
+}
+
+func (it *nodeIterator) Parent() common.Hash {
+	if len(it.stack) == 0 {
+		return common.Hash{}
+	}
+	return it.stack[len(it.stack)-1].parent
+}
+
+func (it *nodeIterator) Leaf() bool {
+	return isLeaf(it.path)
+}
+
+func (it *nodeIterator) LeafKey() []byte {
+	if len(it.stack) > 0 {
+		if _, ok := it.stack[len(it.stack)-1].node.(valueNode); ok {
+			return hex2key(it.path)
+		}
+	}
+	panic("not at leaf")
+}
+
+func (it *nodeIterator) LeafBlob() []byte {
+	if len(it.stack) > 0 {
+		if nd, ok := it.stack[len(it.stack)-1].node.(valueNode); ok {
+			return nd
+		}
+	}
+	panic("not at leaf")
+}
+
+func (it *nodeIterator) Path() []byte {
+	return it.path
+}
+
+func (it *nodeIterator) Error() error {
+	if it.err == errIteratorEnd {
+		return nil
+	}
+	if seek, ok := it.err.(seekError); ok {
+		return seek.err
+	}
+	return it.err
+}
+
+// 出错时返回false，错误通过Error()取出
+func (it *nodeIterator) Next(descend bool) bool {
+	if it.err == errIteratorEnd {
+		return false
+	}
+	// 初始定位失败的（比如缺少节点），重新定位一次
+	if seek, ok := it.err.(seekError); ok {
+		if it.err = it.seek(seek.key); it.err != nil {
+			return false
+		}
+	}
+	state, parentIndex, path, err := it.peek(descend)
+	it.err = err
+	if it.err != nil {
+		return false
+	}
+	it.push(state, parentIndex, path)
+	return true
+}
+
+// 定位到第一个路径不小于prefix的节点之前
+func (it *nodeIterator) seek(prefix []byte) error {
+	// 要找的是不带判断位的路径
+	hexKey := key2hex(prefix)
+	hexKey = hexKey[:len(hexKey)-1]
+	for {
+		// 只有在当前路径是目标的前缀时才需要往下走
+		state, parentIndex, path, err := it.peek(bytes.HasPrefix(hexKey, it.path))
+		if err == errIteratorEnd {
+			return errIteratorEnd
+		} else if err != nil {
+			return seekError{prefix, err}
+		} else if compareHexPath(path, hexKey) >= 0 {
+			return nil
+		}
+		it.push(state, parentIndex, path)
+	}
+}
+
+// 计算下一个状态，但不入栈
+func (it *nodeIterator) peek(descend bool) (*nodeIteratorState, *int, []byte, error) {
+	if len(it.stack) == 0 {
+		// 刚开始迭代，从根节点开始
+		state := &nodeIteratorState{node: it.trie.root, index: -1}
+		if hash, _ := it.trie.root.cache(); hash != nil {
+			state.hash = common.BytesToHash(hash)
+		}
+		err := state.resolve(it.trie, nil)
+		return state, nil, nil, err
+	}
+	if !descend {
+		// 跳过子节点，直接把当前节点出栈
+		it.pop()
+	}
+	for len(it.stack) > 0 {
+		parent := it.stack[len(it.stack)-1]
+		ancestor := parent.hash
+		if (ancestor == common.Hash{}) {
+			ancestor = parent.parent
+		}
+		state, path, ok := it.nextChild(parent, ancestor)
+		if ok {
+			if err := state.resolve(it.trie, path); err != nil {
+				return parent, &parent.index, path, err
+			}
+			return state, &parent.index, path, nil
+		}
+		// 没有子节点了，回到上一层
+		it.pop()
+	}
+	return nil, nil, nil, errIteratorEnd
+}
+
+// hashedNode在这里才从数据库中解析
+func (st *nodeIteratorState) resolve(t *Mpt, path []byte) error {
+	if hash, ok := st.node.(hashedNode); ok {
+		resolved, err := t.resolveHashedNode(hash, path)
+		if err != nil {
+			return err
+		}
+		st.node = resolved
+		st.hash = common.BytesToHash(hash)
+	}
+	return nil
+}
+
+func (it *nodeIterator) nextChild(parent *nodeIteratorState, ancestor common.Hash) (*nodeIteratorState, []byte, bool) {
+	switch nd := parent.node.(type) {
+	case *branchNode:
+		// 按访问顺序找下一个非空的子节点
+		for pos := parent.index + 1; pos < len(it.order); pos++ {
+			i := it.order[pos]
+			child := nd.Children[i]
+			if child != nil {
+				hash, _ := child.cache()
+				state := &nodeIteratorState{
+					hash:    common.BytesToHash(hash),
+					node:    child,
+					parent:  ancestor,
+					index:   -1,
+					pathlen: len(it.path),
+				}
+				path := append(it.path, byte(i))
+				parent.index = pos - 1
+				return state, path, true
+			}
+		}
+	case *shortNode:
+		// shortNode只有一个子节点
+		if parent.index < 0 {
+			hash, _ := nd.Value.cache()
+			state := &nodeIteratorState{
+				hash:    common.BytesToHash(hash),
+				node:    nd.Value,
+				parent:  ancestor,
+				index:   -1,
+				pathlen: len(it.path),
+			}
+			path := append(it.path, nd.Key...)
+			return state, path, true
+		}
+	}
+	return parent, it.path, false
+}
+
+func (it *nodeIterator) push(state *nodeIteratorState, parentIndex *int, path []byte) {
+	it.path = path
+	it.stack = append(it.stack, state)
+	if parentIndex != nil {
+		*parentIndex++
+	}
+}
+
+func (it *nodeIterator) pop() {
+	parent := it.stack[len(it.stack)-1]
+	it.path = it.path[:parent.pathlen]
+	it.stack = it.stack[:len(it.stack)-1]
+}
+
+/**
+差异迭代器：给出b中有、a中没有的节点
+两个迭代器按同样的顺序前进，比较当前节点（路径、是否叶子、哈希、叶子的值）：
+	b落后于a：b的节点在a中不存在，输出
+	b超过了a：a往前追
+	相同：如果节点有哈希，说明整棵子树都相同，两边同时跳过子树；嵌入节点没有哈希，只能继续往下比较
+*/
+
+func compareNodes(a, b NodeIterator) int {
+	if cmp := compareHexPath(a.Path(), b.Path()); cmp != 0 {
+		return cmp
+	}
+	if a.Leaf() && !b.Leaf() {
+		return -1
+	} else if b.Leaf() && !a.Leaf() {
+		return 1
+	}
+	if cmp := bytes.Compare(a.Hash().Bytes(), b.Hash().Bytes()); cmp != 0 {
+		return cmp
+	}
+	if a.Leaf() && b.Leaf() {
+		return bytes.Compare(a.LeafBlob(), b.LeafBlob())
+	}
+	return 0
+}
+
+type differenceIterator struct {
+	a, b  NodeIterator // 输出b - a
+	eof   bool         // a已经走完
+	count int          // 两边一共访问过的节点数
+}
+
+// 返回迭代器，以及记录访问节点数的计数器
+// a、b通常是同一个Database中两个root的节点迭代器
+func NewDifferenceIterator(a, b NodeIterator) (NodeIterator, *int) {
+	it := &differenceIterator{
+		a: a,
+		b: b,
+	}
+	// a为空时b的所有节点都要输出
+	it.eof = !a.Next(true)
+	return it, &it.count
+}
+
+func (it *differenceIterator) Hash() common.Hash {
+	return it.b.Hash()
+}
+
+func (it *differenceIterator) Parent() common.Hash {
+	return it.b.Parent()
+}
+
+func (it *differenceIterator) Leaf() bool {
+	return it.b.Leaf()
+}
+
+func (it *differenceIterator) LeafKey() []byte {
+	return it.b.LeafKey()
+}
+
+func (it *differenceIterator) LeafBlob() []byte {
+	return it.b.LeafBlob()
+}
+
+func (it *differenceIterator) Path() []byte {
+	return it.b.Path()
+}
+
+// descend参数不起作用，相同的子树总会被跳过
+// 约定：每次调用b至少前进一步；进入函数时a的位置在b之后
+func (it *differenceIterator) Next(bool) bool {
+	if !it.b.Next(true) {
+		return false
+	}
+	it.count++
+
+	if it.eof {
+		// a已经走完，b剩下的全部输出
+		return true
+	}
+	for {
+		switch compareNodes(it.a, it.b) {
+		case -1:
+			// b超过了a，a往前追
+			if !it.a.Next(true) {
+				it.eof = true
+				return true
+			}
+			it.count++
+		case 1:
+			// b在a之前，a中没有这个节点
+			return true
+		case 0:
+			// 节点相同，有哈希的整棵子树都相同，直接跳过
+			descend := it.a.Hash() == common.Hash{}
+			if !it.b.Next(descend) {
+				return false
+			}
+			it.count++
+			if !it.a.Next(descend) {
+				it.eof = true
+				return true
+			}
+			it.count++
+		}
+	}
+}
+
+func (it *differenceIterator) Error() error {
+	if err := it.a.Error(); err != nil {
+		return err
+	}
+	return it.b.Error()
+}
@@ -0,0 +1,371 @@
+package mpt
+
+import (
+	"bytes"
+	"ethereum-practice/mpt/database"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"math/rand"
+	"testing"
+)
+
+// 收集所有叶子
+func leavesOf(it NodeIterator) (keys, values [][]byte) {
+	for it.Next(true) {
+		if it.Leaf() {
+			keys = append(keys, common.CopyBytes(it.LeafKey()))
+			values = append(values, common.CopyBytes(it.LeafBlob()))
+		}
+	}
+	return keys, values
+}
+
+func TestEmptyNodeIterator(t *testing.T) {
+	mpt := newEmpty()
+	it := mpt.NodeIterator(nil)
+	if it.Next(true) {
+		t.Errorf("iterator of an empty trie should not return any node")
+	}
+	if it.Error() != nil {
+		t.Errorf("unexpected error: %v", it.Error())
+	}
+}
+
+func TestNodeIteratorLeavesInOrder(t *testing.T) {
+	mpt, vals := randomTrie(1000)
+	entries := sortedEntries(vals)
+
+	keys, values := leavesOf(mpt.NodeIterator(nil))
+	if len(keys) != len(entries) {
+		t.Fatalf("leaf count mismatch: have %d, want %d", len(keys), len(entries))
+	}
+	for i, entry := range entries {
+		if !bytes.Equal(keys[i], entry.k) || !bytes.Equal(values[i], entry.v) {
+			t.Fatalf("leaf %d mismatch: have %x=%x, want %x=%x", i, keys[i], values[i], entry.k, entry.v)
+		}
+	}
+}
+
+func TestNodeIteratorStart(t *testing.T) {
+	mpt, vals := randomTrie(1000)
+	entries := sortedEntries(vals)
+	for _, start := range []int{0, 1, 100, 500, len(entries) - 1} {
+		keys, _ := leavesOf(mpt.NodeIterator(entries[start].k))
+		if len(keys) != len(entries)-start {
+			t.Fatalf("start %d: leaf count mismatch: have %d, want %d", start, len(keys), len(entries)-start)
+		}
+		if !bytes.Equal(keys[0], entries[start].k) {
+			t.Fatalf("start %d: first leaf %x, want %x", start, keys[0], entries[start].k)
+		}
+	}
+	// 从不存在的key开始，定位到第一个更大的key
+	start := increaseKey(common.CopyBytes(entries[10].k))
+	keys, _ := leavesOf(mpt.NodeIterator(start))
+	if !bytes.Equal(keys[0], entries[11].k) {
+		t.Fatalf("first leaf %x, want %x", keys[0], entries[11].k)
+	}
+}
+
+// 提交后重新打开，迭代应当覆盖数据库中的所有节点
+func TestNodeIteratorCoverage(t *testing.T) {
+	mpt, _ := randomTrie(500)
+	diskdb := newKeyCollector()
+	mpt.db = NewDatabaseWithStore(diskdb)
+	root, _ := mpt.Commit()
+	mpt.Database().Commit(root)
+
+	reopened, _ := NewWithDatabase(root, mpt.Database())
+	hashes := make(map[common.Hash]struct{})
+	for it := reopened.NodeIterator(nil); it.Next(true); {
+		if it.Hash() != (common.Hash{}) {
+			hashes[it.Hash()] = struct{}{}
+		}
+	}
+	if err := reopened.NodeIterator(nil).Error(); err != nil {
+		t.Fatalf("unexpected iterator error: %v", err)
+	}
+	// 访问到的每个哈希都能在数据库中找到，且内容一致
+	for hash := range hashes {
+		blob, err := diskdb.Get(hash[:])
+		if err != nil {
+			t.Fatalf("node %x missing from database: %v", hash, err)
+		}
+		if crypto.Keccak256Hash(blob) != hash {
+			t.Fatalf("node %x has mismatching content", hash)
+		}
+	}
+	// 数据库中的每个节点都应当被访问到
+	for _, key := range diskdb.keys {
+		if _, ok := hashes[common.BytesToHash(key)]; !ok {
+			t.Fatalf("node %x was not visited", key)
+		}
+	}
+}
+
+func TestNodeIteratorSkipSubtree(t *testing.T) {
+	mpt, vals := randomTrie(1000)
+	entries := sortedEntries(vals)
+
+	// 跳过根节点下第一个分支（路径以0开头）
+	it := mpt.NodeIterator(nil)
+	var keys [][]byte
+	for descend := true; it.Next(descend); {
+		descend = true
+		if len(it.Path()) == 1 && it.Path()[0] == 0 {
+			descend = false
+			continue
+		}
+		if it.Leaf() {
+			keys = append(keys, common.CopyBytes(it.LeafKey()))
+		}
+	}
+	var want [][]byte
+	for _, entry := range entries {
+		if entry.k[0]>>4 != 0 {
+			want = append(want, entry.k)
+		}
+	}
+	if len(keys) != len(want) {
+		t.Fatalf("leaf count mismatch: have %d, want %d", len(keys), len(want))
+	}
+	for i := range want {
+		if !bytes.Equal(keys[i], want[i]) {
+			t.Fatalf("leaf %d mismatch: have %x, want %x", i, keys[i], want[i])
+		}
+	}
+}
+
+func TestNodeIteratorMissingNode(t *testing.T) {
+	mpt, _ := randomTrie(500)
+	diskdb := database.NewMemoryDatabase()
+	mpt.db = NewDatabaseWithStore(diskdb)
+	root, _ := mpt.Commit()
+	mpt.Database().Commit(root)
+
+	// 删掉根节点下的一个节点
+	reopened, _ := NewWithDatabase(root, mpt.Database())
+	var missing common.Hash
+	for it := reopened.NodeIterator(nil); it.Next(true); {
+		if len(it.Path()) == 1 && it.Hash() != (common.Hash{}) {
+			missing = it.Hash()
+			break
+		}
+	}
+	diskdb.Delete(missing[:])
+
+	reopened, _ = NewWithDatabase(root, mpt.Database())
+	it := reopened.NodeIterator(nil)
+	for it.Next(true) {
+	}
+	if it.Error() == nil {
+		t.Fatalf("expected error for missing node %x", missing)
+	}
+}
+
+func TestIteratorForward(t *testing.T) {
+	mpt, vals := randomTrie(1000)
+	entries := sortedEntries(vals)
+
+	it := mpt.Iterator(nil)
+	for i := 0; it.Next(); i++ {
+		if !bytes.Equal(it.Key, entries[i].k) || !bytes.Equal(it.Value, entries[i].v) {
+			t.Fatalf("entry %d mismatch: have %x=%x, want %x=%x", i, it.Key, it.Value, entries[i].k, entries[i].v)
+		}
+	}
+	if it.Err != nil {
+		t.Fatalf("unexpected error: %v", it.Err)
+	}
+}
+
+func TestIteratorReverse(t *testing.T) {
+	mpt, vals := randomTrie(1000)
+	entries := sortedEntries(vals)
+
+	it, i := mpt.ReverseIterator(nil), len(entries)-1
+	for ; it.Next(); i-- {
+		if !bytes.Equal(it.Key, entries[i].k) || !bytes.Equal(it.Value, entries[i].v) {
+			t.Fatalf("entry %d mismatch: have %x=%x, want %x=%x", i, it.Key, it.Value, entries[i].k, entries[i].v)
+		}
+	}
+	if i != -1 {
+		t.Fatalf("reverse iteration stopped early at %d", i)
+	}
+}
+
+func TestIteratorSeek(t *testing.T) {
+	mpt, vals := randomTrie(1000)
+	entries := sortedEntries(vals)
+
+	for _, index := range []int{0, 1, 150, 333, 500, len(entries) - 1} {
+		// 存在的key
+		it := mpt.Iterator(nil)
+		it.Seek(entries[index].k)
+		if !it.Next() || !bytes.Equal(it.Key, entries[index].k) {
+			t.Fatalf("seek %x: have %x", entries[index].k, it.Key)
+		}
+		rit := mpt.ReverseIterator(nil)
+		rit.Seek(entries[index].k)
+		if !rit.Next() || !bytes.Equal(rit.Key, entries[index].k) {
+			t.Fatalf("reverse seek %x: have %x", entries[index].k, rit.Key)
+		}
+		if index > 0 && (!rit.Next() || !bytes.Equal(rit.Key, entries[index-1].k)) {
+			t.Fatalf("reverse seek %x: next is %x, want %x", entries[index].k, rit.Key, entries[index-1].k)
+		}
+		// 不存在的key，正向落到后一个，反向落到前一个
+		between := increaseKey(common.CopyBytes(entries[index].k))
+		if _, ok := vals[string(between)]; ok {
+			continue
+		}
+		it.Seek(between)
+		if index == len(entries)-1 {
+			if it.Next() {
+				t.Fatalf("seek past the last key: have %x", it.Key)
+			}
+		} else if !it.Next() || !bytes.Equal(it.Key, entries[index+1].k) {
+			t.Fatalf("seek %x: have %x, want %x", between, it.Key, entries[index+1].k)
+		}
+		rit.Seek(between)
+		if !rit.Next() || !bytes.Equal(rit.Key, entries[index].k) {
+			t.Fatalf("reverse seek %x: have %x, want %x", between, rit.Key, entries[index].k)
+		}
+	}
+}
+
+func TestIteratorAfterCommit(t *testing.T) {
+	mpt, vals := randomTrie(500)
+	entries := sortedEntries(vals)
+	root, _ := mpt.Commit()
+
+	reopened, _ := NewWithDatabase(root, mpt.Database())
+	it, i := reopened.ReverseIterator(entries[300].k), 300
+	for ; it.Next(); i-- {
+		if !bytes.Equal(it.Key, entries[i].k) {
+			t.Fatalf("entry %d mismatch: have %x, want %x", i, it.Key, entries[i].k)
+		}
+	}
+	if it.Err != nil || i != -1 {
+		t.Fatalf("unexpected end at %d: %v", i, it.Err)
+	}
+}
+
+// 一个key是另一个key的前缀时，短的key按字节序在前
+func TestIteratorPrefixKeys(t *testing.T) {
+	mpt := newEmpty()
+	keys := []string{"d", "do", "dog", "doge", "dogs", "dot", "e"}
+	for i := len(keys) - 1; i >= 0; i-- {
+		mpt.Insert([]byte(keys[i]), []byte(keys[i]))
+	}
+	it, i := mpt.Iterator(nil), 0
+	for ; it.Next(); i++ {
+		if string(it.Key) != keys[i] {
+			t.Fatalf("entry %d: have %q, want %q", i, it.Key, keys[i])
+		}
+	}
+	if i != len(keys) {
+		t.Fatalf("iterated %d entries, want %d", i, len(keys))
+	}
+	rit, i := mpt.ReverseIterator([]byte("dog")), 2
+	for ; rit.Next(); i-- {
+		if string(rit.Key) != keys[i] {
+			t.Fatalf("reverse entry %d: have %q, want %q", i, rit.Key, keys[i])
+		}
+	}
+	if i != -1 {
+		t.Fatalf("reverse iteration stopped early at %d", i)
+	}
+	it = mpt.Iterator([]byte("dof"))
+	if !it.Next() || string(it.Key) != "dog" {
+		t.Fatalf("seek dof: have %q, want %q", it.Key, "dog")
+	}
+}
+
+func TestDifferenceIterator(t *testing.T) {
+	mpt, vals := randomTrie(500)
+	rootA, _ := mpt.Commit()
+
+	// 在A的基础上修改得到B
+	random := rand.New(rand.NewSource(9))
+	changed := make(map[string][]byte)
+	for k := range vals {
+		switch random.Intn(50) {
+		case 0:
+			mpt.Delete([]byte(k))
+		case 1:
+			value := []byte{byte(random.Intn(256)), 0xff}
+			mpt.Insert([]byte(k), value)
+			changed[k] = value
+		}
+	}
+	for i := 0; i < 5; i++ {
+		key := make([]byte, 32)
+		random.Read(key)
+		mpt.Insert(key, key)
+		changed[string(key)] = key
+	}
+	rootB, _ := mpt.Commit()
+
+	a, _ := NewWithDatabase(rootA, mpt.Database())
+	b, _ := NewWithDatabase(rootB, mpt.Database())
+	it, count := NewDifferenceIterator(a.NodeIterator(nil), b.NodeIterator(nil))
+
+	found := make(map[string][]byte)
+	diffHashes := make(map[common.Hash]struct{})
+	for it.Next(true) {
+		if it.Leaf() {
+			found[string(it.LeafKey())] = common.CopyBytes(it.LeafBlob())
+		}
+		if it.Hash() != (common.Hash{}) {
+			diffHashes[it.Hash()] = struct{}{}
+		}
+	}
+	if it.Error() != nil {
+		t.Fatalf("unexpected error: %v", it.Error())
+	}
+	if len(found) != len(changed) {
+		t.Fatalf("found %d changed leaves, want %d", len(found), len(changed))
+	}
+	for k, v := range changed {
+		if !bytes.Equal(found[k], v) {
+			t.Fatalf("leaf %x: have %x, want %x", k, found[k], v)
+		}
+	}
+	// 输出的哈希恰好是B中有、A中没有的节点
+	hashesA, hashesB := nodeHashes(a), nodeHashes(b)
+	for hash := range hashesB {
+		_, inA := hashesA[hash]
+		_, inDiff := diffHashes[hash]
+		if inA == inDiff {
+			t.Fatalf("node %x: in A %t, reported as difference %t", hash, inA, inDiff)
+		}
+	}
+	if total := nodeCount(a) + nodeCount(b); *count >= total/2 {
+		t.Errorf("difference iterator visited %d of %d nodes, expected to skip shared subtrees", *count, total)
+	}
+}
+
+func TestDifferenceIteratorEmptyBase(t *testing.T) {
+	mpt, vals := randomTrie(100)
+	it, _ := NewDifferenceIterator(newEmpty().NodeIterator(nil), mpt.NodeIterator(nil))
+	keys, _ := leavesOf(it)
+	if len(keys) != len(vals) {
+		t.Fatalf("found %d leaves, want %d", len(keys), len(vals))
+	}
+}
+
+func nodeHashes(mpt *Mpt) map[common.Hash]struct{} {
+	hashes := make(map[common.Hash]struct{})
+	for it := mpt.NodeIterator(nil); it.Next(true); {
+		if it.Hash() != (common.Hash{}) {
+			hashes[it.Hash()] = struct{}{}
+		}
+	}
+	return hashes
+}
+
+func nodeCount(mpt *Mpt) int {
+	count := 0
+	for it := mpt.NodeIterator(nil); it.Next(true); {
+		count++
+	}
+	return count
+}
@@ -65,34 +65,24 @@ func hex2key(hex []byte) []byte{
 }
 
 // 2个条件组合出4种情况，分类讨论
-// todo 与源码实现有较大差别，需要对4分支都提供测试用例覆盖
+// 注意奇偶性要按去掉叶子判断位之后的nibble数计算，否则叶子节点的奇偶会判反
 func hex2hpe(hex []byte) []byte{
-	boolLeaf, boolOdd := isLeaf(hex), len(hex)&1 == 1
-	if boolOdd {
-		if boolLeaf{
-			hpe := make([]byte, (len(hex)-1)/2+1)
-			hpe[0] = HpeOddNibblesFlag | HpeLeafFlag | extractHighNibble(hex[0])
-			nibblesIntoByteInplace(hex[:len(hex)-1], hpe[1:])
-			return hpe
-		} else {
-			hpe := make([]byte, len(hex)/2+1)
-			hpe[0] = HpeOddNibblesFlag | extractHighNibble(hex[0])
-			nibblesIntoByteInplace(hex[:len(hex)-1], hpe[1:])
-			return hpe
-		}
+	var flag byte
+	if isLeaf(hex) {
+		flag = HpeLeafFlag
+		hex = hex[:len(hex)-1]
+	}
+	hpe := make([]byte, len(hex)/2+1)
+	if len(hex)&1 == 1 {
+		// 奇数个nibble，第一个nibble放进首字节的低4位
+		hpe[0] = flag | HpeOddNibblesFlag | hex[0]
+		nibblesIntoByteInplace(hex[1:], hpe[1:])
 	} else {
-		if boolLeaf{
-			hpe := make([]byte, (len(hex)-1)/2+1)
-			hpe[0] = HpeLeafFlag
-			nibblesIntoByteInplace(hex, hpe[1:])
-			return hpe
-		} else {
-			hpe := make([]byte, len(hex)/2+1)
-			nibblesIntoByteInplace(hex, hpe[1:])
-			// hpe[0] 自动初始化为0值
-			return hpe
-		}
+		// 偶数个nibble，首字节低4位补0
+		hpe[0] = flag
+		nibblesIntoByteInplace(hex, hpe[1:])
 	}
+	return hpe
 }
 
 func hex2hpeInplace(hex []byte){
@@ -120,6 +110,30 @@ func hpe2hex(hpe []byte) []byte {
 }
 
 
+// 比较两个hex路径，与bytes.Compare的区别是叶子判断位排在所有nibble之前
+// 判断位意味着key在此结束，而以它为前缀的更长的key按字节序一定更大
+func compareHexPath(a, b []byte) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] == b[i] {
+			continue
+		}
+		if a[i] == HexLeafFlag {
+			return -1
+		}
+		if b[i] == HexLeafFlag || a[i] > b[i] {
+			return 1
+		}
+		return -1
+	}
+	switch {
+	case len(a) < len(b):
+		return -1
+	case len(a) > len(b):
+		return 1
+	}
+	return 0
+}
+
 func isLeaf(s []byte) bool {
 	return len(s) > 0 && s[len(s) - 1] == HexLeafFlag
 }
@@ -50,3 +50,27 @@ func BenchmarkCompactToHex(b *testing.B) {
 		hpe2hex(testBytes)
 	}
 }
+
+func TestHexCompact(t *testing.T) {
+	tests := []struct{ hex, hpe []byte }{
+		// empty keys, with and without terminator.
+		{hex: []byte{}, hpe: []byte{0x00}},
+		{hex: []byte{16}, hpe: []byte{0x20}},
+		// odd length, no terminator
+		{hex: []byte{1, 2, 3, 4, 5}, hpe: []byte{0x11, 0x23, 0x45}},
+		// even length, no terminator
+		{hex: []byte{0, 1, 2, 3, 4, 5}, hpe: []byte{0x00, 0x01, 0x23, 0x45}},
+		// odd length, terminator
+		{hex: []byte{15, 1, 12, 11, 8, 16 /*term*/}, hpe: []byte{0x3f, 0x1c, 0xb8}},
+		// even length, terminator
+		{hex: []byte{0, 15, 1, 12, 11, 8, 16 /*term*/}, hpe: []byte{0x20, 0x0f, 0x1c, 0xb8}},
+	}
+	for _, test := range tests {
+		if c := hex2hpe(test.hex); !bytes.Equal(c, test.hpe) {
+			t.Errorf("hex2hpe(%x) -> %x, want %x", test.hex, c, test.hpe)
+		}
+		if h := hpe2hex(test.hpe); !bytes.Equal(h, test.hex) {
+			t.Errorf("hpe2hex(%x) -> %x, want %x", test.hpe, h, test.hex)
+		}
+	}
+}
@@ -37,11 +37,13 @@ import (
 	主要会用到 Split SplitList SplitString 函数，返回值都是获得第一个Rlp串（Rlp开头是长度标记）和剩余部分，非常适合递归算法
 	CountValues返回编码中存在的对象数量
 
+实际的树长什么样，可以用Mpt.Dump画出来（文本或Graphviz），见dump.go
 */
 
 // 节点应当满足的一些公有方法
+// cache返回节点已计算的哈希值（hashedNode）以及节点是否dirty，只有shortNode和branchNode会缓存哈希
 type node interface {
-
+	cache() (hashedNode, bool)
 }
 
 // nodeStatus对应源码的nodeFlag，主要与缓存管理有关
@@ -65,6 +67,11 @@ type(
 	valueNode	[]byte
 )
 
+func (n *branchNode) cache() (hashedNode, bool) {return n.status.hash, n.status.dirty}
+func (n *shortNode) cache() (hashedNode, bool) {return n.status.hash, n.status.dirty}
+func (n hashedNode) cache() (hashedNode, bool) {return nil, true}
+func (n valueNode) cache() (hashedNode, bool) {return nil, true}
+
 // 找出公共前缀长度
 func commonKeyLength(a []byte, b[]byte) int {
 	var minLength = len(a)
@@ -86,14 +93,22 @@ func commonKeyLength(a []byte, b[]byte) int {
 // 尝试解析hashedNode
 // 对应源码中的func (t *Trie) resolveHash
 
-// prefix用来打印路径，不是特别重要
+// prefix是节点的hex路径，出错时放进错误信息，便于定位
+// 数据库中没有该节点时返回MissingNodeError，解码失败时返回CorruptNodeError
+// 读取本身出错（数据库坏了，而不是少了节点）时原样带出底层的error，附上哈希和路径
 func resolveHash(db *Database, hash common.Hash, prefix []byte) (node, error) {
-	encoded, err := db.diskdb.Get(hash[:])
-	if err != nil || encoded == nil {return nil, err}
-
+	encoded, err := db.node(hash)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read trie node %x (path %x): %w", hash, prefix, err)
+	}
+	if len(encoded) == 0 {
+		return nil, &MissingNodeError{NodeHash: hash, Path: common.CopyBytes(prefix)}
+	}
 	n, err := decodeNode(hash[:], encoded)
-	if err != nil { panic(fmt.Sprintf("node %x: %v", hash, err)) }
-	return n, err
+	if err != nil {
+		return nil, &CorruptNodeError{NodeHash: hash, Path: common.CopyBytes(prefix), Blob: encoded, Err: err}
+	}
+	return n, nil
 }
 
 func resolveHashedNode(db *Database, node hashedNode, prefix []byte) (node, error) {
@@ -117,12 +132,18 @@ func (n *branchNode) EncodeRLP(w io.Writer) error {
 	return rlp.Encode(w, nodes)
 }
 
-// shortNode本身只暴露Key和Value，核心代码是用反射实现取值
+// shortNode本身只暴露Key和Value
+// 注意不能直接rlp.Encode(w, n)，*shortNode实现了Encoder接口，会无限递归回到这里
+// 另外，Key按原样编码，调用方（hasher）负责先把hex格式的Key转成hpe格式
 func (n *shortNode) EncodeRLP(w io.Writer) error {
-	return rlp.Encode(w, n)
+	return rlp.Encode(w, []interface{}{n.Key, n.Value})
 }
 
+// 剩余的key比Key短时（查询的key是树中某个key的前缀）一定不相等
 func (n *shortNode) EqualsKey(hexKey []byte, startsFrom int) bool {
+	if len(hexKey)-startsFrom < len(n.Key) {
+		return false
+	}
 	return bytes.Equal(n.Key, hexKey[startsFrom : startsFrom + len(n.Key)])
 }
 
@@ -177,11 +198,11 @@ func decodeNode(hash, rlpEncoded []byte) (node, error) {
 			nd.Children[i] = child
 			elements = restOfChild
 		}
-		// 第17个节点如果非空一定是valueNode
+		// 第17个节点如果非空一定是valueNode，对应以当前路径结尾的key（它是其它key的前缀）
 		value, _, err := rlp.SplitString(elements)
 		if err != nil {return nil, fmt.Errorf("error occurs when parsing value node of branchNode")}
 		if len(value) > 0 {
-			nd.Children[count] = append(valueNode{}, value...)
+			nd.Children[16] = append(valueNode{}, value...)
 		}
 		return nd, nil
 	} else {					// rlp编码模式越界
@@ -1,32 +1,47 @@
 package mpt
 
 import (
-	"bytes"
-	"fmt"
 	"testing"
 )
 
 func TestCommonKeyLength(t *testing.T) {
-	a, b := []byte{1,2,3,4}, []byte{1,2}
-	c, d := []byte{1,2,3,4}, []byte{1,4,2,3,1,4,1}
-	e, f := []byte{}, []byte{1,4,2,3,1,4,1}
-
-	fmt.Println(commonKeyLength(a, b))
-	fmt.Println(commonKeyLength(c, d))
-	fmt.Println(commonKeyLength(e, f))
-
+	tests := []struct {
+		a, b []byte
+		want int
+	}{
+		{[]byte{1, 2, 3, 4}, []byte{1, 2}, 2},
+		{[]byte{1, 2, 3, 4}, []byte{1, 4, 2, 3, 1, 4, 1}, 1},
+		{[]byte{}, []byte{1, 4, 2, 3, 1, 4, 1}, 0},
+		{[]byte{1, 2, 3}, []byte{1, 2, 3}, 3},
+	}
+	for _, test := range tests {
+		if have := commonKeyLength(test.a, test.b); have != test.want {
+			t.Errorf("commonKeyLength(%x, %x): have %d want %d", test.a, test.b, have, test.want)
+		}
+		if have := commonKeyLength(test.b, test.a); have != test.want {
+			t.Errorf("commonKeyLength(%x, %x): have %d want %d", test.b, test.a, have, test.want)
+		}
+	}
 }
 
-
-func TestEqual(t *testing.T) {
-	//a, b := []byte{1,2,3,4}, []byte{1,2}
-	a, b := []byte{}, []byte{1,2}
-
-	fmt.Println(bytes.Equal(a, b))
-
-
-	//fmt.Println(append(nil,1,2,3))
+func TestEqualsKey(t *testing.T) {
+	n := &shortNode{Key: []byte{1, 2}}
+	tests := []struct {
+		hexKey []byte
+		start  int
+		want   bool
+	}{
+		{[]byte{1, 2}, 0, true},
+		{[]byte{0, 1, 2, 16}, 1, true},
+		{[]byte{0, 1, 3, 16}, 1, false},
+		// 剩余的key比Key短
+		{[]byte{1}, 0, false},
+		{[]byte{0, 1}, 1, false},
+		{[]byte{}, 0, false},
+	}
+	for _, test := range tests {
+		if have := n.EqualsKey(test.hexKey, test.start); have != test.want {
+			t.Errorf("EqualsKey(%x, %d): have %v want %v", test.hexKey, test.start, have, test.want)
+		}
+	}
 }
-
-
-
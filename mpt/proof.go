@@ -0,0 +1,508 @@
+package mpt
+
+import (
+	"bytes"
+	"errors"
+	"ethereum-practice/rlp"
+	"fmt"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+/**
+默克尔证明，对应源码的trie/proof.go
+证明的内容就是从根节点到key所在位置路径上的所有节点（rlp编码），以 hash -> rlp(node) 的形式写入proofDb
+	1.key存在：最后一个节点中包含value，验证方沿着哈希一路走下去就能取出value（inclusion proof）
+	2.key不存在：路径在某个节点处断掉（shortNode的key不匹配，或者branchNode对应位置为空），
+	  这个节点本身就证明了key不存在（exclusion proof）
+嵌入节点不单独写入，它已经包含在父节点的编码里了；根节点例外，无论大小都要写入
+*/
+
+// 为key构造证明，写入proofDb
+func (t *Mpt) Prove(key []byte, proofDb KeyValueWriter) error {
+	// 先收集路径上的所有节点
+	// pos是已经走过的nibble数，hexKey[:pos]即当前节点的路径
+	hexKey, pos := key2hex(key), 0
+	var nodes []node
+	tn := t.root
+	for pos < len(hexKey) && tn != nil {
+		switch nd := tn.(type) {
+		case *shortNode:
+			if len(hexKey)-pos < len(nd.Key) || !nd.EqualsKey(hexKey, pos) {
+				// key不存在
+				tn = nil
+			} else {
+				tn = nd.Value
+				pos += len(nd.Key)
+			}
+			nodes = append(nodes, nd)
+		case *branchNode:
+			tn = nd.Children[hexKey[pos]]
+			pos++
+			nodes = append(nodes, nd)
+		case hashedNode:
+			var err error
+			tn, err = t.resolveHashedNode(nd, hexKey[:pos])
+			if err != nil {
+				return err
+			}
+		default:
+			panic(fmt.Sprintf("errors occurs when processing node: %v", tn))
+		}
+	}
+	h := newHasher(false)
+	defer returnHasherToPool(h)
+
+	for i, nd := range nodes {
+		collapsed, hashed := h.proofHash(nd)
+		// 有哈希值的节点，以及根节点，作为证明的一部分
+		if hash, ok := hashed.(hashedNode); ok || i == 0 {
+			enc, err := rlp.EncodeToBytes(collapsed)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				hash = h.hashData(enc)
+			}
+			if err := proofDb.Put(hash, enc); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// 验证证明：从root开始，按哈希在proofDb中取出节点并解码，沿key走下去
+// key存在时返回value；证明了key不存在时返回nil, nil；证明本身有问题时返回error
+func VerifyProof(root common.Hash, key []byte, proofDb KeyValueReader) ([]byte, error) {
+	hexKey := key2hex(key)
+	wantHash := root
+	for i := 0; ; i++ {
+		buf, _ := proofDb.Get(wantHash[:])
+		if buf == nil {
+			return nil, fmt.Errorf("proof node %d (hash %064x) missing", i, wantHash)
+		}
+		nd, err := decodeNode(wantHash[:], buf)
+		if err != nil {
+			return nil, fmt.Errorf("bad proof node %d: %v", i, err)
+		}
+		restOfKey, child := getChildInNode(nd, hexKey, true)
+		switch child := child.(type) {
+		case nil:
+			// key不存在
+			return nil, nil
+		case hashedNode:
+			hexKey = restOfKey
+			copy(wantHash[:], child)
+		case valueNode:
+			return child, nil
+		}
+	}
+}
+
+// 在一个解码出来的节点（包含其中的嵌入节点）内部沿hexKey往下走，直到遇到hashedNode、valueNode或者无法继续
+// 返回剩余的key以及停下来的位置上的节点
+// skipResolved为true时，遇到内存中已展开的子节点不停下，继续往下走；为false时每走一步就返回
+func getChildInNode(tn node, hexKey []byte, skipResolved bool) ([]byte, node) {
+	for {
+		switch nd := tn.(type) {
+		case *shortNode:
+			if len(hexKey) < len(nd.Key) || !nd.EqualsKey(hexKey, 0) {
+				return nil, nil
+			}
+			tn = nd.Value
+			hexKey = hexKey[len(nd.Key):]
+			if !skipResolved {
+				return hexKey, tn
+			}
+		case *branchNode:
+			tn = nd.Children[hexKey[0]]
+			hexKey = hexKey[1:]
+			if !skipResolved {
+				return hexKey, tn
+			}
+		case hashedNode:
+			return hexKey, nd
+		case nil:
+			return hexKey, nil
+		case valueNode:
+			return nil, nd
+		default:
+			panic(fmt.Sprintf("errors occurs when processing node: %v", tn))
+		}
+	}
+}
+
+/**
+范围证明（snap sync中用到的做法）
+证明方给出一段连续的、按key排序的叶子（keys, values），以及左右两个边界key的证明（firstKey, lastKey各一条路径）
+验证方的思路：
+	1.用两条边界路径上的节点拼出一棵“骨架树”，它和原树的形状一致，但只展开了两条边界路径
+	2.把两条路径之间的内部引用全部清掉（unsetInternal），这部分本应由给出的叶子重新构造出来
+	3.把叶子插入骨架树，重新计算根哈希，与root一致则说明这批叶子恰好是两个边界之间的全部内容
+边界证明允许是不存在证明，即firstKey、lastKey本身可以不在树中
+*/
+
+// 为[firstKey, lastKey]范围构造两条边界证明，写入proofDb
+// 范围内的叶子由调用方另行提供（比如用迭代器取出）
+func (t *Mpt) ProveRange(firstKey, lastKey []byte, proofDb KeyValueWriter) error {
+	if err := t.Prove(firstKey, proofDb); err != nil {
+		return err
+	}
+	if bytes.Equal(firstKey, lastKey) {
+		return nil
+	}
+	return t.Prove(lastKey, proofDb)
+}
+
+// 把证明中的一条路径还原成树，路径上的节点都解析出来，其余部分保持hashedNode
+// root不为空时，新路径会合并到已有的树上
+// allowNonExistent为true时，允许路径在中途断掉（不存在证明）
+func proofToPath(rootHash common.Hash, root node, key []byte, proofDb KeyValueReader, allowNonExistent bool) (node, []byte, error) {
+	resolveNode := func(hash common.Hash) (node, error) {
+		buf, _ := proofDb.Get(hash[:])
+		if buf == nil {
+			return nil, fmt.Errorf("proof node (hash %064x) missing", hash)
+		}
+		nd, err := decodeNode(hash[:], buf)
+		if err != nil {
+			return nil, fmt.Errorf("bad proof node %v", err)
+		}
+		return nd, err
+	}
+	// 根节点一定在证明中
+	if root == nil {
+		nd, err := resolveNode(rootHash)
+		if err != nil {
+			return nil, nil, err
+		}
+		root = nd
+	}
+	var (
+		err           error
+		child, parent node
+		restOfKey     []byte
+		value         []byte
+	)
+	hexKey, parent := key2hex(key), root
+	for {
+		restOfKey, child = getChildInNode(parent, hexKey, false)
+		switch cld := child.(type) {
+		case nil:
+			// 路径断掉了，key不存在；不过已经解析出来的节点都是正确的，对证明范围来说足够了
+			if allowNonExistent {
+				return root, nil, nil
+			}
+			return nil, nil, errors.New("the node is not contained in trie")
+		case *shortNode, *branchNode:
+			// 嵌入节点，已经解析过了
+			hexKey, parent = restOfKey, child
+			continue
+		case hashedNode:
+			child, err = resolveNode(common.BytesToHash(cld))
+			if err != nil {
+				return nil, nil, err
+			}
+		case valueNode:
+			value = cld
+		}
+		// 把解析出来的子节点挂到父节点上
+		switch pnode := parent.(type) {
+		case *shortNode:
+			pnode.Value = child
+		case *branchNode:
+			pnode.Children[hexKey[0]] = child
+		default:
+			panic(fmt.Sprintf("errors occurs when processing node: %v", pnode))
+		}
+		if len(value) > 0 {
+			return root, value, nil
+		}
+		hexKey, parent = restOfKey, child
+	}
+}
+
+// 清掉两条边界路径之间的所有内部引用（hashedNode和嵌入节点），这部分要由叶子重新构造
+// 路径上的节点内容可能会变，全部标记为dirty
+// 前提：left < right，且都是构造边界路径时用的key
+// 返回true表示分叉点就是根节点，并且整棵树都在范围内，调用方应当把整棵树清空
+func unsetInternal(n node, left []byte, right []byte) (bool, error) {
+	left, right = key2hex(left), key2hex(right)
+
+	// 先往下走到分叉点，有两种情况：
+	// 1.分叉点是shortNode：左右边界的key至少有一个与shortNode的key不匹配
+	// 2.分叉点是branchNode：左右边界走向了不同的子节点（允许指向空节点）
+	var (
+		pos    = 0
+		parent node
+		// 0表示没有分叉，-1表示边界key小于shortNode的key，1表示大于
+		shortForkLeft, shortForkRight int
+	)
+findFork:
+	for {
+		switch rn := (n).(type) {
+		case *shortNode:
+			rn.status = nodeStatus{dirty: true}
+			if len(left)-pos < len(rn.Key) {
+				shortForkLeft = bytes.Compare(left[pos:], rn.Key)
+			} else {
+				shortForkLeft = bytes.Compare(left[pos:pos+len(rn.Key)], rn.Key)
+			}
+			if len(right)-pos < len(rn.Key) {
+				shortForkRight = bytes.Compare(right[pos:], rn.Key)
+			} else {
+				shortForkRight = bytes.Compare(right[pos:pos+len(rn.Key)], rn.Key)
+			}
+			if shortForkLeft != 0 || shortForkRight != 0 {
+				break findFork
+			}
+			parent = n
+			n, pos = rn.Value, pos+len(rn.Key)
+		case *branchNode:
+			rn.status = nodeStatus{dirty: true}
+			leftNode, rightNode := rn.Children[left[pos]], rn.Children[right[pos]]
+			if leftNode == nil || rightNode == nil || leftNode != rightNode {
+				break findFork
+			}
+			parent = n
+			n, pos = rn.Children[left[pos]], pos+1
+		default:
+			return false, fmt.Errorf("invalid node on the edge path: %v", n)
+		}
+	}
+	switch rn := n.(type) {
+	case *shortNode:
+		// 五种情况：
+		// 1.左右边界都小于shortNode的路径 => 范围为空
+		// 2.左右边界都大于shortNode的路径 => 范围为空
+		// 3.左边界小于、右边界大于 => 整个shortNode都在范围内，直接清掉
+		// 4.左边界指向shortNode，右边界大于
+		// 5.右边界指向shortNode，左边界小于
+		if shortForkLeft == -1 && shortForkRight == -1 {
+			return false, errors.New("empty range")
+		}
+		if shortForkLeft == 1 && shortForkRight == 1 {
+			return false, errors.New("empty range")
+		}
+		if shortForkLeft != 0 && shortForkRight != 0 {
+			return unsetChild(parent, left, pos)
+		}
+		// 只有一条边界路径指向不存在的key
+		if shortForkRight != 0 {
+			if _, ok := rn.Value.(valueNode); ok {
+				return unsetChild(parent, left, pos)
+			}
+			return false, unset(rn, rn.Value, left[pos:], len(rn.Key), false)
+		}
+		if shortForkLeft != 0 {
+			if _, ok := rn.Value.(valueNode); ok {
+				return unsetChild(parent, right, pos)
+			}
+			return false, unset(rn, rn.Value, right[pos:], len(rn.Key), true)
+		}
+		return false, nil
+	case *branchNode:
+		// 分叉点之间的子节点全部清掉
+		for i := left[pos] + 1; i < right[pos]; i++ {
+			rn.Children[i] = nil
+		}
+		if err := unset(rn, rn.Children[left[pos]], left[pos:], 1, false); err != nil {
+			return false, err
+		}
+		if err := unset(rn, rn.Children[right[pos]], right[pos:], 1, true); err != nil {
+			return false, err
+		}
+		return false, nil
+	default:
+		return false, fmt.Errorf("invalid node at the fork point: %v", n)
+	}
+}
+
+// 分叉点的shortNode整个在范围内，从父节点中清掉，hexKey[pos-1]是它在父节点中的位置
+// 父节点为nil说明分叉点就是根节点，整棵树都在范围内；合法的树中shortNode的父节点只能是branchNode
+func unsetChild(parent node, hexKey []byte, pos int) (bool, error) {
+	switch p := parent.(type) {
+	case nil:
+		return true, nil
+	case *branchNode:
+		p.Children[hexKey[pos-1]] = nil
+		return false, nil
+	default:
+		return false, fmt.Errorf("invalid parent of short node: %v", parent)
+	}
+}
+
+// 沿一条边界路径清掉一侧的内部引用，removeLeft为true时清掉路径左侧，否则清掉右侧
+// 路径不存在时：
+//	1.分叉点是branchNode，对应的子节点为空，直接返回
+//	2.分叉点是shortNode，shortNode在范围内，整个分支清掉
+//	3.分叉点是shortNode，shortNode在范围外，保留（它的哈希值仍然可用）
+func unset(parent node, child node, hexKey []byte, pos int, removeLeft bool) error {
+	switch cld := child.(type) {
+	case *branchNode:
+		if removeLeft {
+			for i := 0; i < int(hexKey[pos]); i++ {
+				cld.Children[i] = nil
+			}
+		} else {
+			for i := hexKey[pos] + 1; i < 16; i++ {
+				cld.Children[i] = nil
+			}
+		}
+		cld.status = nodeStatus{dirty: true}
+		return unset(cld, cld.Children[hexKey[pos]], hexKey, pos+1, removeLeft)
+	case *shortNode:
+		if len(hexKey[pos:]) < len(cld.Key) || !cld.EqualsKey(hexKey, pos) {
+			// 找到分叉点，路径不存在
+			// removeLeft时shortNode的key小于路径，否则大于路径，就在范围内，整个分支清掉
+			cmp := bytes.Compare(cld.Key, hexKey[pos:])
+			if (removeLeft && cmp < 0) || (!removeLeft && cmp > 0) {
+				_, err := unsetChild(parent, hexKey, pos)
+				return err
+			}
+			return nil
+		}
+		if _, ok := cld.Value.(valueNode); ok {
+			_, err := unsetChild(parent, hexKey, pos)
+			return err
+		}
+		cld.status = nodeStatus{dirty: true}
+		return unset(cld, cld.Value, hexKey, pos+len(cld.Key), removeLeft)
+	case nil:
+		// 分叉点branchNode下不存在的分支
+		return nil
+	default:
+		// hashedNode, valueNode，合法的证明中不会出现
+		return fmt.Errorf("invalid node on the edge path: %v", child)
+	}
+}
+
+// 判断路径右侧是否还有其他元素，路径可以指向存在或不存在的key
+// 前提是整条路径都已经解析过了
+func hasRightElement(nd node, key []byte) bool {
+	pos, hexKey := 0, key2hex(key)
+	for nd != nil {
+		switch rn := nd.(type) {
+		case *branchNode:
+			for i := hexKey[pos] + 1; i < 16; i++ {
+				if rn.Children[i] != nil {
+					return true
+				}
+			}
+			nd, pos = rn.Children[hexKey[pos]], pos+1
+		case *shortNode:
+			if len(hexKey)-pos < len(rn.Key) || !rn.EqualsKey(hexKey, pos) {
+				return bytes.Compare(rn.Key, hexKey[pos:]) > 0
+			}
+			nd, pos = rn.Value, pos+len(rn.Key)
+		case valueNode:
+			return false // 整条路径都走完了
+		case hashedNode:
+			// 没有展开的子树（来自不可信的输入，路径不一定都解析过），其中一定还有元素
+			return true
+		default:
+			panic(fmt.Sprintf("errors occurs when processing node: %v", nd))
+		}
+	}
+	return false
+}
+
+// 验证范围证明：keys/values必须是严格递增、连续（中间没有缺漏）的一段叶子
+// firstKey与第一条边界证明对应，不一定等于keys[0]（除非是存在证明），lastKey同理
+// 几种特殊情况：
+//	1.proof为nil：keys/values应当是整棵树的全部叶子
+//	2.只有一个元素，且两个边界key相同：只需一条证明
+//	3.没有元素：一条不存在证明即可，如果右侧还有元素则返回错误
+// keys必须落在[firstKey, lastKey]之内，value不能为空（空value在Insert中表示删除，范围证明中不允许）
+// 除了error，还返回右侧是否还有更多元素
+func VerifyRangeProof(root common.Hash, firstKey []byte, lastKey []byte, keys [][]byte, values [][]byte, proof KeyValueReader) (bool, error) {
+	if len(keys) != len(values) {
+		return false, fmt.Errorf("inconsistent proof data, keys: %d, values: %d", len(keys), len(values))
+	}
+	// 必须严格递增
+	for i := 0; i < len(keys)-1; i++ {
+		if bytes.Compare(keys[i], keys[i+1]) >= 0 {
+			return false, errors.New("range is not monotonically increasing")
+		}
+	}
+	for _, value := range values {
+		if len(value) == 0 {
+			return false, errors.New("range contains deletion")
+		}
+	}
+	// 没有边界证明，叶子应当是整棵树
+	if proof == nil {
+		emptyTrie := &Mpt{db: NewDatabase()}
+		for i, key := range keys {
+			if err := emptyTrie.Insert(key, values[i]); err != nil {
+				return false, err
+			}
+		}
+		if hash := emptyTrie.Hash(); hash != root {
+			return false, fmt.Errorf("invalid proof, want hash %x, got %x", root, hash)
+		}
+		return false, nil
+	}
+	// 有边界证明但没有叶子，证明右侧没有更多元素
+	if len(keys) == 0 {
+		rn, value, err := proofToPath(root, nil, firstKey, proof, true)
+		if err != nil {
+			return false, err
+		}
+		if value != nil || hasRightElement(rn, firstKey) {
+			return false, errors.New("more entries available")
+		}
+		return false, nil
+	}
+	// 只有一个元素且两个边界相同，构造不出两条路径，单独处理
+	if len(keys) == 1 && bytes.Equal(firstKey, lastKey) {
+		rn, value, err := proofToPath(root, nil, firstKey, proof, false)
+		if err != nil {
+			return false, err
+		}
+		if !bytes.Equal(firstKey, keys[0]) {
+			return false, errors.New("correct proof but invalid key")
+		}
+		if !bytes.Equal(value, values[0]) {
+			return false, errors.New("correct proof but invalid data")
+		}
+		return hasRightElement(rn, firstKey), nil
+	}
+	// 其余情况需要两条边界路径
+	if bytes.Compare(firstKey, lastKey) >= 0 {
+		return false, errors.New("invalid edge keys")
+	}
+	if len(firstKey) != len(lastKey) {
+		return false, errors.New("inconsistent edge keys")
+	}
+	// 范围之外的key会落到没有展开的hashedNode中，插入失败；即使插入成功也不在证明的范围内
+	if bytes.Compare(firstKey, keys[0]) > 0 || bytes.Compare(keys[len(keys)-1], lastKey) > 0 {
+		return false, errors.New("keys out of range")
+	}
+	// 两条边界证明都允许是不存在证明，第二条路径合并到第一条的树上
+	rn, _, err := proofToPath(root, nil, firstKey, proof, true)
+	if err != nil {
+		return false, err
+	}
+	rn, _, err = proofToPath(root, rn, lastKey, proof, true)
+	if err != nil {
+		return false, err
+	}
+	empty, err := unsetInternal(rn, firstKey, lastKey)
+	if err != nil {
+		return false, err
+	}
+	if empty {
+		rn = nil
+	}
+	// 用叶子重新构造被清掉的部分，形状应当与原树一致
+	newTrie := &Mpt{root: rn, db: NewDatabase()}
+	for i, key := range keys {
+		if err := newTrie.Insert(key, values[i]); err != nil {
+			return false, err
+		}
+	}
+	if hash := newTrie.Hash(); hash != root {
+		return false, fmt.Errorf("invalid proof, want hash %x, got %x", root, hash)
+	}
+	return hasRightElement(rn, keys[len(keys)-1]), nil
+}
@@ -0,0 +1,478 @@
+package mpt
+
+import (
+	"bytes"
+	"ethereum-practice/mpt/database"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func randomTrie(n int) (*Mpt, map[string][]byte) {
+	random := rand.New(rand.NewSource(int64(n)))
+	mpt := newEmpty()
+	vals := make(map[string][]byte)
+	for i := byte(0); i < 100; i++ {
+		// 短key短value，会产生嵌入节点
+		key, value := common.LeftPadBytes([]byte{i}, 32), []byte{i}
+		mpt.Insert(key, value)
+		vals[string(key)] = value
+		key2, value2 := common.LeftPadBytes([]byte{i + 10}, 32), []byte{i}
+		mpt.Insert(key2, value2)
+		vals[string(key2)] = value2
+	}
+	for i := 0; i < n; i++ {
+		key, value := make([]byte, 32), make([]byte, 20)
+		random.Read(key)
+		random.Read(value)
+		mpt.Insert(key, value)
+		vals[string(key)] = value
+	}
+	return mpt, vals
+}
+
+func TestProof(t *testing.T) {
+	mpt, vals := randomTrie(500)
+	root := mpt.Hash()
+	for k, v := range vals {
+		proof := database.NewMemoryDatabase()
+		if err := mpt.Prove([]byte(k), proof); err != nil {
+			t.Fatalf("prove error for key %x: %v", k, err)
+		}
+		value, err := VerifyProof(root, []byte(k), proof)
+		if err != nil {
+			t.Fatalf("verify error for key %x: %v", k, err)
+		}
+		if !bytes.Equal(value, v) {
+			t.Fatalf("verified value mismatch for key %x: have %x, want %x", k, value, v)
+		}
+	}
+}
+
+func TestProofAfterCommit(t *testing.T) {
+	mpt, vals := randomTrie(200)
+	root, _ := mpt.Commit()
+	reopened, _ := NewWithDatabase(root, mpt.Database())
+	for k, v := range vals {
+		proof := database.NewMemoryDatabase()
+		if err := reopened.Prove([]byte(k), proof); err != nil {
+			t.Fatalf("prove error for key %x: %v", k, err)
+		}
+		if value, err := VerifyProof(root, []byte(k), proof); err != nil || !bytes.Equal(value, v) {
+			t.Fatalf("verify failed for key %x: have %x, want %x, err %v", k, value, v, err)
+		}
+	}
+}
+
+func TestOneElementProof(t *testing.T) {
+	mpt := newEmpty()
+	mpt.Insert([]byte("k"), []byte("v"))
+	proof := database.NewMemoryDatabase()
+	mpt.Prove([]byte("k"), proof)
+	value, err := VerifyProof(mpt.Hash(), []byte("k"), proof)
+	if err != nil {
+		t.Fatalf("verify error: %v", err)
+	}
+	if !bytes.Equal(value, []byte("v")) {
+		t.Fatalf("verified value mismatch: have %x, want 'v'", value)
+	}
+}
+
+func TestMissingKeyProof(t *testing.T) {
+	mpt, vals := randomTrie(500)
+	root := mpt.Hash()
+	random := rand.New(rand.NewSource(4))
+	for i := 0; i < 100; i++ {
+		key := make([]byte, 32)
+		random.Read(key)
+		if _, ok := vals[string(key)]; ok {
+			continue
+		}
+		proof := database.NewMemoryDatabase()
+		if err := mpt.Prove(key, proof); err != nil {
+			t.Fatalf("prove error for key %x: %v", key, err)
+		}
+		value, err := VerifyProof(root, key, proof)
+		if err != nil {
+			t.Fatalf("verify error for missing key %x: %v", key, err)
+		}
+		if value != nil {
+			t.Fatalf("verified value for missing key %x: have %x, want nil", key, value)
+		}
+	}
+}
+
+func TestBadProof(t *testing.T) {
+	mpt, vals := randomTrie(500)
+	root := mpt.Hash()
+	random := rand.New(rand.NewSource(5))
+	for k := range vals {
+		proof := newKeyCollector()
+		mpt.Prove([]byte(k), proof)
+		// 篡改其中一个节点，以篡改后的哈希重新写入，原哈希对应的节点就找不到了
+		hash := proof.keys[random.Intn(len(proof.keys))]
+		enc, _ := proof.Get(hash)
+		proof.Delete(hash)
+		enc[random.Intn(len(enc))] ^= 0xff
+		proof.Put(crypto.Keccak256(enc), enc)
+		if _, err := VerifyProof(root, []byte(k), proof); err == nil {
+			t.Fatalf("expected proof to fail for key %x", k)
+		}
+	}
+}
+
+func TestEmptyTrieProof(t *testing.T) {
+	mpt := newEmpty()
+	proof := database.NewMemoryDatabase()
+	if err := mpt.Prove([]byte("k"), proof); err != nil {
+		t.Fatalf("prove error: %v", err)
+	}
+	// 空树没有任何节点，验证必然失败
+	if _, err := VerifyProof(EmptyRoot, []byte("k"), proof); err == nil {
+		t.Fatalf("expected error for empty proof")
+	}
+}
+
+// 记录写入的key，方便测试中挑选证明节点
+type keyCollector struct {
+	*database.MemoryDatabase
+	keys [][]byte
+}
+
+func newKeyCollector() *keyCollector {
+	return &keyCollector{MemoryDatabase: database.NewMemoryDatabase()}
+}
+
+func (c *keyCollector) Put(key []byte, value []byte) error {
+	c.keys = append(c.keys, common.CopyBytes(key))
+	return c.MemoryDatabase.Put(key, value)
+}
+
+type entry struct{ k, v []byte }
+
+func sortedEntries(vals map[string][]byte) []entry {
+	var entries []entry
+	for k, v := range vals {
+		entries = append(entries, entry{[]byte(k), v})
+	}
+	sort.Slice(entries, func(i, j int) bool { return bytes.Compare(entries[i].k, entries[j].k) < 0 })
+	return entries
+}
+
+func entryRange(entries []entry, start, end int) (keys, values [][]byte) {
+	for i := start; i < end; i++ {
+		keys = append(keys, entries[i].k)
+		values = append(values, entries[i].v)
+	}
+	return keys, values
+}
+
+func TestRangeProof(t *testing.T) {
+	mpt, vals := randomTrie(4096)
+	root := mpt.Hash()
+	entries := sortedEntries(vals)
+	random := rand.New(rand.NewSource(6))
+	for i := 0; i < 100; i++ {
+		start := random.Intn(len(entries))
+		end := random.Intn(len(entries)-start) + start + 1
+
+		proof := database.NewMemoryDatabase()
+		if err := mpt.ProveRange(entries[start].k, entries[end-1].k, proof); err != nil {
+			t.Fatalf("failed to prove range: %v", err)
+		}
+		keys, values := entryRange(entries, start, end)
+		hasMore, err := VerifyRangeProof(root, keys[0], keys[len(keys)-1], keys, values, proof)
+		if err != nil {
+			t.Fatalf("case %d(%d->%d) expect no error, got %v", i, start, end-1, err)
+		}
+		if hasMore != (end < len(entries)) {
+			t.Fatalf("case %d(%d->%d) wrong hasMore indicator %t", i, start, end-1, hasMore)
+		}
+	}
+}
+
+func TestRangeProofWithNonExistentProof(t *testing.T) {
+	mpt, vals := randomTrie(4096)
+	root := mpt.Hash()
+	entries := sortedEntries(vals)
+	random := rand.New(rand.NewSource(7))
+	for i := 0; i < 100; i++ {
+		start := random.Intn(len(entries))
+		end := random.Intn(len(entries)-start) + start + 1
+
+		// 边界key取相邻的不存在的key，跳过溢出以及恰好与相邻元素相同的情况
+		first := decreaseKey(common.CopyBytes(entries[start].k))
+		if start != 0 && bytes.Equal(first, entries[start-1].k) || bytes.Compare(first, entries[start].k) > 0 {
+			continue
+		}
+		last := increaseKey(common.CopyBytes(entries[end-1].k))
+		if end != len(entries) && bytes.Equal(last, entries[end].k) || bytes.Compare(last, entries[end-1].k) < 0 {
+			continue
+		}
+		proof := database.NewMemoryDatabase()
+		if err := mpt.ProveRange(first, last, proof); err != nil {
+			t.Fatalf("failed to prove range: %v", err)
+		}
+		keys, values := entryRange(entries, start, end)
+		if _, err := VerifyRangeProof(root, first, last, keys, values, proof); err != nil {
+			t.Fatalf("case %d(%d->%d) expect no error, got %v", i, start, end-1, err)
+		}
+	}
+}
+
+func TestAllElementsRangeProof(t *testing.T) {
+	mpt, vals := randomTrie(4096)
+	root := mpt.Hash()
+	entries := sortedEntries(vals)
+	keys, values := entryRange(entries, 0, len(entries))
+
+	// 不带边界证明
+	if _, err := VerifyRangeProof(root, nil, nil, keys, values, nil); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	// 带存在证明
+	proof := database.NewMemoryDatabase()
+	mpt.ProveRange(keys[0], keys[len(keys)-1], proof)
+	if _, err := VerifyRangeProof(root, keys[0], keys[len(keys)-1], keys, values, proof); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	// 带不存在证明
+	proof = database.NewMemoryDatabase()
+	first, last := common.Hash{}.Bytes(), common.HexToHash("0xffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff").Bytes()
+	mpt.ProveRange(first, last, proof)
+	if _, err := VerifyRangeProof(root, first, last, keys, values, proof); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	// 缺一个元素就不行
+	if _, err := VerifyRangeProof(root, nil, nil, keys[1:], values[1:], nil); err == nil {
+		t.Fatalf("expected error for incomplete range")
+	}
+}
+
+func TestSingleElementRangeProof(t *testing.T) {
+	mpt, vals := randomTrie(4096)
+	root := mpt.Hash()
+	entries := sortedEntries(vals)
+
+	// 两个边界相同
+	start := 1000
+	proof := database.NewMemoryDatabase()
+	mpt.ProveRange(entries[start].k, entries[start].k, proof)
+	hasMore, err := VerifyRangeProof(root, entries[start].k, entries[start].k, [][]byte{entries[start].k}, [][]byte{entries[start].v}, proof)
+	if err != nil || !hasMore {
+		t.Fatalf("expected no error and more elements, got %v, %t", err, hasMore)
+	}
+	// 左边界是不存在证明
+	first := decreaseKey(common.CopyBytes(entries[start].k))
+	proof = database.NewMemoryDatabase()
+	mpt.ProveRange(first, entries[start].k, proof)
+	if _, err := VerifyRangeProof(root, first, entries[start].k, [][]byte{entries[start].k}, [][]byte{entries[start].v}, proof); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	// 值被篡改
+	proof = database.NewMemoryDatabase()
+	mpt.ProveRange(entries[start].k, entries[start].k, proof)
+	if _, err := VerifyRangeProof(root, entries[start].k, entries[start].k, [][]byte{entries[start].k}, [][]byte{[]byte("bad")}, proof); err == nil {
+		t.Fatalf("expected error for modified value")
+	}
+}
+
+func TestEmptyRangeProof(t *testing.T) {
+	mpt, vals := randomTrie(4096)
+	root := mpt.Hash()
+	entries := sortedEntries(vals)
+
+	// 最右侧之后确实没有元素
+	first := increaseKey(common.CopyBytes(entries[len(entries)-1].k))
+	proof := database.NewMemoryDatabase()
+	mpt.Prove(first, proof)
+	if _, err := VerifyRangeProof(root, first, nil, nil, nil, proof); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	// 右侧还有元素
+	first = decreaseKey(common.CopyBytes(entries[len(entries)-1].k))
+	proof = database.NewMemoryDatabase()
+	mpt.Prove(first, proof)
+	if _, err := VerifyRangeProof(root, first, nil, nil, nil, proof); err == nil {
+		t.Fatalf("expected error when more entries are available")
+	}
+}
+
+func TestBadRangeProof(t *testing.T) {
+	mpt, vals := randomTrie(4096)
+	root := mpt.Hash()
+	entries := sortedEntries(vals)
+	random := rand.New(rand.NewSource(8))
+	randBytes := func(n int) []byte {
+		b := make([]byte, n)
+		random.Read(b)
+		return b
+	}
+	for i := 0; i < 100; i++ {
+		start := random.Intn(len(entries))
+		end := random.Intn(len(entries)-start) + start + 1
+		proof := database.NewMemoryDatabase()
+		mpt.ProveRange(entries[start].k, entries[end-1].k, proof)
+		keys, values := entryRange(entries, start, end)
+		first, last := keys[0], keys[len(keys)-1]
+
+		testcase := random.Intn(5)
+		index := random.Intn(end - start)
+		switch testcase {
+		case 0:
+			// 修改key
+			keys[index] = randBytes(32)
+		case 1:
+			// 修改value
+			values[index] = randBytes(20)
+		case 2:
+			// 中间缺了一个元素
+			if index == 0 || index == end-start-1 {
+				continue
+			}
+			keys = append(keys[:index], keys[index+1:]...)
+			values = append(values[:index], values[index+1:]...)
+		case 3:
+			// 顺序错乱
+			other := random.Intn(end - start)
+			if index == other {
+				continue
+			}
+			keys[index], keys[other] = keys[other], keys[index]
+			values[index], values[other] = values[other], values[index]
+		case 4:
+			// value置空
+			values[index] = nil
+		}
+		if _, err := VerifyRangeProof(root, first, last, keys, values, proof); err == nil {
+			t.Fatalf("%d case %d index %d range: (%d->%d) expect error, got nil", i, testcase, index, start, end-1)
+		}
+	}
+}
+
+// 边界证明之外的key、空value、多出来的key都不能通过验证，也不能让验证panic
+func TestRangeProofForgedEntries(t *testing.T) {
+	mpt, vals := randomTrie(4096)
+	root := mpt.Hash()
+	entries := sortedEntries(vals)
+	start, end := 150, 180
+	proof := database.NewMemoryDatabase()
+	if err := mpt.ProveRange(entries[start].k, entries[end-1].k, proof); err != nil {
+		t.Fatalf("failed to prove range: %v", err)
+	}
+	first, last := entries[start].k, entries[end-1].k
+	// 范围中间一个不存在的key
+	missing := increaseKey(common.CopyBytes(entries[160].k))
+
+	tests := []struct {
+		name   string
+		modify func(keys, values [][]byte) ([][]byte, [][]byte)
+	}{
+		{"key before range", func(keys, values [][]byte) ([][]byte, [][]byte) {
+			// 范围之前真实存在的key，value是伪造的
+			return append([][]byte{entries[20].k}, keys...), append([][]byte{[]byte("forged")}, values...)
+		}},
+		{"key after range", func(keys, values [][]byte) ([][]byte, [][]byte) {
+			return append(keys, entries[300].k), append(values, entries[300].v)
+		}},
+		{"extra key", func(keys, values [][]byte) ([][]byte, [][]byte) {
+			keys = append(keys[:11], append([][]byte{missing}, keys[11:]...)...)
+			values = append(values[:11], append([][]byte{[]byte("extra")}, values[11:]...)...)
+			return keys, values
+		}},
+		{"extra key with empty value", func(keys, values [][]byte) ([][]byte, [][]byte) {
+			keys = append(keys[:11], append([][]byte{missing}, keys[11:]...)...)
+			values = append(values[:11], append([][]byte{{}}, values[11:]...)...)
+			return keys, values
+		}},
+		{"empty value", func(keys, values [][]byte) ([][]byte, [][]byte) {
+			values[5] = []byte{}
+			return keys, values
+		}},
+	}
+	for _, test := range tests {
+		keys, values := test.modify(entryRange(entries, start, end))
+		if _, err := VerifyRangeProof(root, first, last, keys, values, proof); err == nil {
+			t.Errorf("%s: expect error, got nil", test.name)
+		}
+	}
+
+	// 没有证明时同样不接受空value
+	small := newEmpty()
+	small.Insert([]byte{1}, []byte("a"))
+	small.Insert([]byte{2}, []byte("b"))
+	keys, values := [][]byte{{1}, {2}, {3}}, [][]byte{[]byte("a"), []byte("b"), {}}
+	if _, err := VerifyRangeProof(small.Hash(), nil, nil, keys, values, nil); err == nil {
+		t.Errorf("whole trie with empty value: expect error, got nil")
+	}
+}
+
+// 分叉点就是根节点：只有一个叶子的树，边界把整个叶子包含在内
+func TestRangeProofRootFork(t *testing.T) {
+	key, value := []byte{0x12, 0x34}, []byte("value")
+	mpt := newEmpty()
+	mpt.Insert(key, value)
+	root := mpt.Hash()
+
+	edges := []struct{ first, last []byte }{
+		{key, []byte{0x12, 0x35}},                // 左边界存在
+		{[]byte{0x12, 0x33}, key},                // 右边界存在
+		{[]byte{0x00, 0x00}, []byte{0xff, 0xff}}, // 两个边界都不存在
+	}
+	for i, edge := range edges {
+		proof := database.NewMemoryDatabase()
+		if err := mpt.ProveRange(edge.first, edge.last, proof); err != nil {
+			t.Fatalf("case %d: failed to prove range: %v", i, err)
+		}
+		more, err := VerifyRangeProof(root, edge.first, edge.last, [][]byte{key}, [][]byte{value}, proof)
+		if err != nil {
+			t.Fatalf("case %d: verification error: %v", i, err)
+		}
+		if more {
+			t.Errorf("case %d: unexpected right element", i)
+		}
+	}
+}
+
+// 拓展节点下面直接是嵌入的shortNode，合法的树中不会出现，验证时应当报错而不是panic
+func TestRangeProofShortNodeParent(t *testing.T) {
+	// [hpe(1), [hpe(2, 16), "v"]]，key 0x12
+	blob := []byte{0xc4, 0x11, 0xc2, 0x32, 'v'}
+	proof := database.NewMemoryDatabase()
+	hash := putRawNode(proof, blob)
+	root := common.BytesToHash(hash)
+	if _, err := VerifyRangeProof(root, []byte{0x11}, []byte{0x13}, [][]byte{{0x12}}, [][]byte{[]byte("v")}, proof); err == nil {
+		t.Errorf("expect error, got nil")
+	}
+}
+
+// 路径上没有展开的子树说明右侧还有元素
+func TestHasRightElementHashedNode(t *testing.T) {
+	root := &branchNode{}
+	root.Children[2] = hashedNode(crypto.Keccak256([]byte("child")))
+	if !hasRightElement(root, []byte{0x20}) {
+		t.Errorf("unexpanded subtree not reported as right element")
+	}
+}
+
+func increaseKey(key []byte) []byte {
+	for i := len(key) - 1; i >= 0; i-- {
+		key[i]++
+		if key[i] != 0x0 {
+			break
+		}
+	}
+	return key
+}
+
+func decreaseKey(key []byte) []byte {
+	for i := len(key) - 1; i >= 0; i-- {
+		key[i]--
+		if key[i] != 0xff {
+			break
+		}
+	}
+	return key
+}
@@ -0,0 +1,148 @@
+package mpt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"ethereum-practice/mpt/database"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/steakknife/bloomfilter"
+)
+
+/**
+离线剪枝，删除底层存储中从给定的root集合出发不可达的节点
+分两步：
+	1.标记：从每个要保留的root出发遍历整棵树，把经过的每个节点的哈希加入bloom过滤器
+	2.清扫：遍历底层存储，key为32字节、且value的keccak等于key（确实是一个节点）的，不在bloom过滤器中就删除
+bloom过滤器只有假阳性：一部分不可达的节点可能被误判为可达而保留下来，但可达的节点一定不会被删
+“离线”：剪枝期间不能有其它Database/Mpt在使用同一个底层存储，clean缓存和dirties都不会同步更新
+注意：账户叶子中引用的storage树不会被自动发现，它们的root也要一起放在roots中
+*/
+
+const (
+	defaultPruneBloomSize = 64    // bloom过滤器默认大小，单位MB
+	pruneBloomHashes      = 4     // bloom过滤器的哈希函数个数
+	pruneReportInterval   = 10000 // 每处理这么多个key汇报一次进度
+)
+
+var errPruneNoRoots = errors.New("no roots to keep, refusing to prune everything")
+
+// 剪枝需要遍历底层存储中所有的key
+type Iteratee interface {
+	NewIterator(prefix []byte, start []byte) database.Iterator
+}
+
+type IterableKeyValueStore interface {
+	KeyValueStore
+	Iteratee
+}
+
+type PruneConfig struct {
+	BloomSize uint64           // bloom过滤器大小，单位MB，0表示使用默认值
+	DryRun    bool             // 只统计，不删除
+	Progress  func(PruneStats) // 进度回调，可以为nil
+}
+
+// 剪枝的进度，最后一次回调（Stage为done）与Prune的返回值相同
+type PruneStats struct {
+	Stage   string // marking / sweeping / done
+	Marked  uint64 // 标记为可达的节点数
+	Scanned uint64 // 清扫阶段扫描过的key数
+	Deleted uint64 // 删除（DryRun时为将要删除）的节点数
+	Freed   uint64 // 删除（DryRun时为将要删除）的key和value的总字节数
+}
+
+// bloom过滤器需要hash.Hash64，节点哈希本身就是均匀分布的，直接取前8个字节
+type pruneBloomHasher []byte
+
+func (f pruneBloomHasher) Write(p []byte) (n int, err error) { panic("not implemented") }
+func (f pruneBloomHasher) Sum(b []byte) []byte               { panic("not implemented") }
+func (f pruneBloomHasher) Reset()                            { panic("not implemented") }
+func (f pruneBloomHasher) BlockSize() int                    { panic("not implemented") }
+func (f pruneBloomHasher) Size() int                         { return 8 }
+func (f pruneBloomHasher) Sum64() uint64                     { return binary.BigEndian.Uint64(f) }
+
+// 保留roots可达的节点，删除其它所有节点，config为nil时使用默认配置
+// 任何一个root不完整（有缺失或损坏的节点）时直接返回错误，不做任何删除
+func Prune(store IterableKeyValueStore, roots []common.Hash, config *PruneConfig) (PruneStats, error) {
+	if config == nil {
+		config = &PruneConfig{}
+	}
+	var stats PruneStats
+	report := func(stage string) {
+		stats.Stage = stage
+		if config.Progress != nil {
+			config.Progress(stats)
+		}
+	}
+	bloomSize := config.BloomSize
+	if bloomSize == 0 {
+		bloomSize = defaultPruneBloomSize
+	}
+	bloom, err := bloomfilter.New(bloomSize*1024*1024*8, pruneBloomHashes)
+	if err != nil {
+		return stats, err
+	}
+
+	// 标记
+	db := NewDatabaseWithStore(store)
+	kept := 0
+	for _, root := range roots {
+		if root == (common.Hash{}) || root == EmptyRoot {
+			continue
+		}
+		kept++
+		t, err := NewWithDatabase(root, db)
+		if err != nil {
+			return stats, err
+		}
+		bloom.Add(pruneBloomHasher(root[:]))
+		stats.Marked++
+		it := t.NodeIterator(nil)
+		for it.Next(true) {
+			if hash := it.Hash(); hash != (common.Hash{}) && hash != root {
+				bloom.Add(pruneBloomHasher(hash[:]))
+				if stats.Marked++; stats.Marked%pruneReportInterval == 0 {
+					report("marking")
+				}
+			}
+		}
+		if err := it.Error(); err != nil {
+			return stats, err
+		}
+	}
+	if kept == 0 {
+		return stats, errPruneNoRoots
+	}
+	report("marking")
+
+	// 清扫
+	it := store.NewIterator(nil, nil)
+	defer it.Release()
+	for it.Next() {
+		if stats.Scanned++; stats.Scanned%pruneReportInterval == 0 {
+			report("sweeping")
+		}
+		key, value := it.Key(), it.Value()
+		if len(key) != common.HashLength || bloom.Contains(pruneBloomHasher(key)) {
+			continue
+		}
+		// 32字节的key不一定是节点（比如其它业务的数据），只删确实是节点的
+		if !bytes.Equal(crypto.Keccak256(value), key) {
+			continue
+		}
+		stats.Deleted++
+		stats.Freed += uint64(len(key) + len(value))
+		if !config.DryRun {
+			if err := store.Delete(key); err != nil {
+				return stats, err
+			}
+		}
+	}
+	if err := it.Error(); err != nil {
+		return stats, err
+	}
+	report("done")
+	return stats, nil
+}
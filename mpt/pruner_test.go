@@ -0,0 +1,106 @@
+package mpt
+
+import (
+	"bytes"
+	"ethereum-practice/mpt/database"
+	"github.com/ethereum/go-ethereum/common"
+	"testing"
+)
+
+// 两个版本的树都落盘，返回底层存储、新旧root以及新root的数据
+func prunableStore(t *testing.T) (*database.MemoryDatabase, common.Hash, common.Hash, map[string][]byte) {
+	diskdb := database.NewMemoryDatabase()
+	db := NewDatabaseWithStore(diskdb)
+	mpt, vals := randomTrie(300)
+	mpt.db = db
+	oldRoot, _ := mpt.Commit()
+	db.Commit(oldRoot)
+	n := 0
+	for k := range vals {
+		vals[k] = []byte("changed")
+		mpt.Insert([]byte(k), vals[k])
+		if n++; n == 50 {
+			break
+		}
+	}
+	newRoot, _ := mpt.Commit()
+	db.Commit(newRoot)
+	return diskdb, oldRoot, newRoot, vals
+}
+
+func storeSize(db *database.MemoryDatabase) (count, size uint64) {
+	it := db.NewIterator(nil, nil)
+	defer it.Release()
+	for it.Next() {
+		count++
+		size += uint64(len(it.Key()) + len(it.Value()))
+	}
+	return count, size
+}
+
+func TestPrune(t *testing.T) {
+	diskdb, oldRoot, newRoot, vals := prunableStore(t)
+	// 不是节点的数据不能被删掉
+	other := common.HexToHash("0x01")
+	diskdb.Put(other[:], []byte("not a node"))
+	diskdb.Put(preimageKey(other), []byte("preimage"))
+
+	count, size := storeSize(diskdb)
+	dry, err := Prune(diskdb, []common.Hash{newRoot}, &PruneConfig{BloomSize: 1, DryRun: true})
+	if err != nil {
+		t.Fatalf("dry run error: %v", err)
+	}
+	if dry.Deleted == 0 || dry.Freed == 0 {
+		t.Fatalf("dry run found nothing to prune: %+v", dry)
+	}
+	if c, s := storeSize(diskdb); c != count || s != size {
+		t.Fatalf("dry run modified the store: %d/%d -> %d/%d", count, size, c, s)
+	}
+
+	var last PruneStats
+	stats, err := Prune(diskdb, []common.Hash{newRoot}, &PruneConfig{BloomSize: 1, Progress: func(p PruneStats) { last = p }})
+	if err != nil {
+		t.Fatalf("prune error: %v", err)
+	}
+	if stats != last || last.Stage != "done" {
+		t.Errorf("last progress report %+v does not match result %+v", last, stats)
+	}
+	if stats.Deleted != dry.Deleted || stats.Freed != dry.Freed {
+		t.Errorf("dry run %+v does not match real run %+v", dry, stats)
+	}
+	if c, s := storeSize(diskdb); c != count-stats.Deleted || s != size-stats.Freed {
+		t.Errorf("store size mismatch: have %d/%d, want %d/%d", c, s, count-stats.Deleted, size-stats.Freed)
+	}
+
+	mpt, err := NewWithDatabase(newRoot, NewDatabaseWithStore(diskdb))
+	if err != nil {
+		t.Fatalf("failed to open kept root: %v", err)
+	}
+	for k, v := range vals {
+		if have, err := mpt.GetValue([]byte(k)); err != nil || !bytes.Equal(have, v) {
+			t.Fatalf("key %x: have %x (%v) want %x", k, have, err, v)
+		}
+	}
+	if ok, _ := diskdb.Has(oldRoot[:]); ok {
+		t.Errorf("old root %x survived pruning", oldRoot)
+	}
+	for _, key := range [][]byte{other[:], preimageKey(other)} {
+		if ok, _ := diskdb.Has(key); !ok {
+			t.Errorf("non-node key %x was deleted", key)
+		}
+	}
+}
+
+func TestPruneMissingRoot(t *testing.T) {
+	diskdb, _, newRoot, _ := prunableStore(t)
+	count, _ := storeSize(diskdb)
+	if _, err := Prune(diskdb, []common.Hash{newRoot, common.HexToHash("0xdead")}, &PruneConfig{BloomSize: 1}); err == nil {
+		t.Fatalf("expected error for missing root")
+	}
+	if _, err := Prune(diskdb, nil, &PruneConfig{BloomSize: 1}); err != errPruneNoRoots {
+		t.Fatalf("expected %v, got %v", errPruneNoRoots, err)
+	}
+	if c, _ := storeSize(diskdb); c != count {
+		t.Fatalf("store modified after failed prune: %d -> %d", count, c)
+	}
+}
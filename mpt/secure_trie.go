@@ -0,0 +1,91 @@
+package mpt
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+/**
+SecureMpt，对应源码的trie/secure_trie.go
+以太坊的状态树和storage树并不直接用原始key，而是用keccak256(key)作为key：
+	1.key的长度固定为32字节，树的深度有上限，不会出现一个key是另一个key前缀的情况
+	2.key分布均匀，攻击者很难构造出很深的路径
+代价是从树中无法还原原始key，所以需要额外记录原像（preimage）：keccak256(key) -> key
+原像先缓存在内存中，Commit时一并交给Database（需要Config.Preimages开启），与节点一样在Database.Commit时才落盘，之后通过GetKey查询
+*/
+
+type SecureMpt struct {
+	mpt         Mpt
+	secKeyCache map[string][]byte // 还没有写入数据库的原像，hashedKey -> key
+}
+
+// 与NewWithDatabase一样，root为空时新建一棵空树
+func NewSecure(root common.Hash, db *Database) (*SecureMpt, error) {
+	mpt, err := NewWithDatabase(root, db)
+	if err != nil {
+		return nil, err
+	}
+	return &SecureMpt{mpt: *mpt}, nil
+}
+
+func (t *SecureMpt) GetValue(key []byte) ([]byte, error) {
+	return t.mpt.GetValue(t.hashKey(key))
+}
+
+// 与Mpt.Insert一致，value为空时相当于Delete
+func (t *SecureMpt) Insert(key, value []byte) error {
+	if len(value) == 0 {
+		return t.Delete(key)
+	}
+	hashedKey := t.hashKey(key)
+	if err := t.mpt.Insert(hashedKey, value); err != nil {
+		return err
+	}
+	t.getSecKeyCache()[string(hashedKey)] = common.CopyBytes(key)
+	return nil
+}
+
+func (t *SecureMpt) Delete(key []byte) error {
+	hashedKey := t.hashKey(key)
+	delete(t.getSecKeyCache(), string(hashedKey))
+	return t.mpt.Delete(hashedKey)
+}
+
+// 由哈希过的key查原始key，先查内存中的缓存，再查数据库
+func (t *SecureMpt) GetKey(hashedKey []byte) []byte {
+	if key, ok := t.getSecKeyCache()[string(hashedKey)]; ok {
+		return key
+	}
+	return t.mpt.db.preimage(common.BytesToHash(hashedKey))
+}
+
+func (t *SecureMpt) Hash() common.Hash {
+	return t.mpt.Hash()
+}
+
+// 把原像和dirty的节点交给Database，与Mpt.Commit一样不写底层存储，要落盘还需要调用Database.Commit(root)
+func (t *SecureMpt) Commit() (common.Hash, error) {
+	if len(t.getSecKeyCache()) > 0 {
+		for hashedKey, key := range t.secKeyCache {
+			t.mpt.db.insertPreimage(common.BytesToHash([]byte(hashedKey)), key)
+		}
+		t.secKeyCache = make(map[string][]byte)
+	}
+	return t.mpt.Commit()
+}
+
+// 底层的树，key都是哈希过的，可以用于迭代、证明等
+func (t *SecureMpt) Trie() *Mpt {
+	return &t.mpt
+}
+
+func (t *SecureMpt) hashKey(key []byte) []byte {
+	return crypto.Keccak256(key)
+}
+
+func (t *SecureMpt) getSecKeyCache() map[string][]byte {
+	if t.secKeyCache == nil {
+		t.secKeyCache = make(map[string][]byte)
+	}
+	return t.secKeyCache
+}
@@ -0,0 +1,121 @@
+package mpt
+
+import (
+	"bytes"
+	"ethereum-practice/mpt/database"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/ethereum/go-ethereum/trie"
+	"math/rand"
+	"testing"
+)
+
+func newEmptySecure() *SecureMpt {
+	mpt, _ := NewSecure(common.Hash{}, NewDatabaseWithConfig(database.NewMemoryDatabase(), &Config{Preimages: true}))
+	return mpt
+}
+
+// 直接用源码的测试例子
+func TestSecureDelete(t *testing.T) {
+	mpt := newEmptySecure()
+	vals := []struct{ k, v string }{
+		{"do", "verb"},
+		{"ether", "wookiedoo"},
+		{"horse", "stallion"},
+		{"shaman", "horse"},
+		{"doge", "coin"},
+		{"ether", ""},
+		{"dog", "puppy"},
+		{"shaman", ""},
+	}
+	for _, val := range vals {
+		if val.v != "" {
+			mpt.Insert([]byte(val.k), []byte(val.v))
+		} else {
+			mpt.Delete([]byte(val.k))
+		}
+	}
+	exp := common.HexToHash("29b235a58c3c25ab83010c327d5932bcf05324b7d6b1185e650798034783ca9d")
+	if hash := mpt.Hash(); hash != exp {
+		t.Errorf("expected %x got %x", exp, hash)
+	}
+}
+
+func TestSecureGetKey(t *testing.T) {
+	mpt := newEmptySecure()
+	key, value := []byte("foo"), []byte("bar")
+	mpt.Insert(key, value)
+
+	if have, _ := mpt.GetValue(key); !bytes.Equal(have, value) {
+		t.Errorf("GetValue returned %q, want %q", have, value)
+	}
+	hashedKey := crypto.Keccak256(key)
+	if k := mpt.GetKey(hashedKey); !bytes.Equal(k, key) {
+		t.Errorf("GetKey returned %q, want %q", k, key)
+	}
+	// 提交之后从数据库中查原像
+	root, _ := mpt.Commit()
+	reopened, _ := NewSecure(root, mpt.Trie().Database())
+	if k := reopened.GetKey(hashedKey); !bytes.Equal(k, key) {
+		t.Errorf("GetKey after commit returned %q, want %q", k, key)
+	}
+	if have, _ := reopened.GetValue(key); !bytes.Equal(have, value) {
+		t.Errorf("GetValue after commit returned %q, want %q", have, value)
+	}
+	// 原像和节点一样，Database.Commit之后才落盘
+	db := mpt.Trie().Database()
+	preimage := preimageKey(common.BytesToHash(hashedKey))
+	if has, _ := db.DiskDB().Has(preimage); has {
+		t.Errorf("preimage written before Database.Commit")
+	}
+	if err := db.Commit(root); err != nil {
+		t.Fatalf("database commit error: %v", err)
+	}
+	if blob, _ := db.DiskDB().Get(preimage); !bytes.Equal(blob, key) {
+		t.Errorf("preimage on disk is %q, want %q", blob, key)
+	}
+}
+
+func TestSecurePreimagesDisabled(t *testing.T) {
+	mpt, _ := NewSecure(common.Hash{}, NewDatabase())
+	key := []byte("foo")
+	mpt.Insert(key, []byte("bar"))
+	root, _ := mpt.Commit()
+
+	reopened, _ := NewSecure(root, mpt.Trie().Database())
+	if k := reopened.GetKey(crypto.Keccak256(key)); k != nil {
+		t.Errorf("GetKey returned %q with preimages disabled", k)
+	}
+}
+
+func TestSecureAgainstGeth(t *testing.T) {
+	random := rand.New(rand.NewSource(10))
+	mpt := newEmptySecure()
+	ref, _ := trie.NewSecure(common.Hash{}, trie.NewDatabase(memorydb.New()))
+	var keys [][]byte
+	for i := 0; i < 1000; i++ {
+		key := make([]byte, 1+random.Intn(20))
+		random.Read(key)
+		value := make([]byte, 1+random.Intn(40))
+		random.Read(value)
+		mpt.Insert(key, value)
+		ref.Update(key, value)
+		keys = append(keys, key)
+	}
+	for _, key := range keys[:200] {
+		mpt.Delete(key)
+		ref.Delete(key)
+	}
+	if have, want := mpt.Hash(), ref.Hash(); have != want {
+		t.Fatalf("root mismatch, have %x want %x", have, want)
+	}
+	root, _ := mpt.Commit()
+	reopened, _ := NewSecure(root, mpt.Trie().Database())
+	for _, key := range keys {
+		have, _ := reopened.GetValue(key)
+		if want := ref.Get(key); !bytes.Equal(have, want) {
+			t.Fatalf("value mismatch for %x, have %x want %x", key, have, want)
+		}
+	}
+}
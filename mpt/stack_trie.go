@@ -0,0 +1,292 @@
+package mpt
+
+import (
+	"bytes"
+	"errors"
+	"ethereum-practice/rlp"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+/**
+StackTrie，对应源码的trie/stacktrie.go
+只接受按key严格递增的顺序插入，用于从有序的数据（交易列表、收据列表、按key排序导出的叶子）计算根哈希
+核心观察：key递增插入时，一旦新key走向了branchNode中更大的子节点，左边的兄弟子树就再也不会被修改了
+	==> 立刻计算它的哈希并释放内存，内存中只保留最右侧的一条路径（类似一个栈），内存占用与树的深度相关，而与叶子数量无关
+节点类型和Mpt一一对应，但为了能随时“收缩”成哈希，使用自己的结构stNode：
+	stLeaf：叶子节点（shortNode + valueNode）
+	stExt：拓展节点（shortNode + 子树）
+	stBranch：分支节点
+	stHashed：已经计算过哈希的子树，val中保存哈希值，或者（不足32字节时）嵌入节点的rlp编码
+编码规则与hasher完全一致，所以根哈希与同样数据的Mpt.Hash()相同
+保存节点：收缩发生在插入过程中，那时还不知道之后调用的是Hash还是Commit，所以db不为nil时收缩下来的节点先暂存，
+Commit时才写入db，Hash不写任何东西；只需要根哈希时传nil，暂存的开销也就没有了
+限制：不支持删除，不支持一个key是另一个key的前缀（branchNode的value位置始终为空）
+*/
+
+var (
+	ErrCommitDisabled     = errors.New("no database for committing")
+	errStackTrieKeyOrder  = errors.New("stack trie keys must be inserted in strictly increasing order")
+	errStackTriePrefixKey = errors.New("stack trie does not support keys that are prefixes of other keys")
+	errStackTrieDeletion  = errors.New("stack trie does not support deletion")
+)
+
+const (
+	stEmpty = iota
+	stBranch
+	stExt
+	stLeaf
+	stHashed
+)
+
+type stNode struct {
+	kind      uint8
+	key       []byte // 本节点覆盖的key片段（hex编码，不含判断位），branchNode为空
+	keyOffset int    // key片段在完整key中的起始位置
+	val       []byte // 叶子的value；收缩之后是哈希值或嵌入节点的编码
+	children  [16]*stNode
+}
+
+type StackTrie struct {
+	root    *stNode
+	db      KeyValueWriter // Commit时节点写到这里，可以为nil
+	pending []stPending    // 已经收缩、等待Commit写入db的节点
+	lastKey []byte
+}
+
+type stPending struct {
+	hash []byte
+	blob []byte
+}
+
+// db为nil时只计算哈希，不保存节点
+func NewStackTrie(db KeyValueWriter) *StackTrie {
+	return &StackTrie{root: &stNode{kind: stEmpty}, db: db}
+}
+
+// 插入(key, value)，key必须比上一次插入的key大
+// Mpt.Insert中空value表示删除，StackTrie不支持删除，返回错误
+func (st *StackTrie) Insert(key, value []byte) error {
+	if len(value) == 0 {
+		return errStackTrieDeletion
+	}
+	if st.lastKey != nil && bytes.Compare(key, st.lastKey) <= 0 {
+		return errStackTrieKeyOrder
+	}
+	if st.root.kind == stHashed {
+		return errStackTrieKeyOrder
+	}
+	hexKey := key2hex(key)
+	if err := st.insert(st.root, hexKey[:len(hexKey)-1], common.CopyBytes(value)); err != nil {
+		return err
+	}
+	st.lastKey = common.CopyBytes(key)
+	return nil
+}
+
+// 清空，可以重新使用
+func (st *StackTrie) Reset() {
+	st.root = &stNode{kind: stEmpty}
+	st.pending = nil
+	st.lastKey = nil
+}
+
+// 计算根哈希，不写入db，之后不能再插入
+func (st *StackTrie) Hash() common.Hash {
+	hash, _ := st.hashRoot(false)
+	return hash
+}
+
+// 计算根哈希，并把所有节点（包括根节点）写入db，之后不能再插入
+func (st *StackTrie) Commit() (common.Hash, error) {
+	if st.db == nil {
+		return common.Hash{}, ErrCommitDisabled
+	}
+	hash, err := st.hashRoot(true)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	for _, p := range st.pending {
+		if err := st.db.Put(p.hash, p.blob); err != nil {
+			return common.Hash{}, err
+		}
+	}
+	st.pending = nil
+	return hash, nil
+}
+
+func (st *StackTrie) hashRoot(commit bool) (common.Hash, error) {
+	if st.root.kind == stEmpty {
+		return EmptyRoot, nil
+	}
+	if err := st.hash(st.root); err != nil {
+		return common.Hash{}, err
+	}
+	if len(st.root.val) == common.HashLength {
+		return common.BytesToHash(st.root.val), nil
+	}
+	// 根节点不足32字节也要做哈希
+	h := newHasher(false)
+	defer returnHasherToPool(h)
+	hash := h.hashData(st.root.val)
+	if commit {
+		if err := st.db.Put(hash, st.root.val); err != nil {
+			return common.Hash{}, err
+		}
+	}
+	return common.BytesToHash(hash), nil
+}
+
+func newStLeaf(keyOffset int, key, value []byte) *stNode {
+	return &stNode{kind: stLeaf, keyOffset: keyOffset, key: append([]byte{}, key...), val: value}
+}
+
+// 找出key片段与完整key从keyOffset开始第一个不同的位置
+func (n *stNode) diffIndex(hexKey []byte) int {
+	i := 0
+	for ; i < len(n.key) && n.key[i] == hexKey[n.keyOffset+i]; i++ {
+	}
+	return i
+}
+
+// hexKey不含判断位
+func (st *StackTrie) insert(n *stNode, hexKey, value []byte) error {
+	switch n.kind {
+	case stBranch:
+		if n.keyOffset >= len(hexKey) {
+			return errStackTriePrefixKey
+		}
+		idx := int(hexKey[n.keyOffset])
+		// 左边最近的兄弟子树不会再变了，收缩；更左边的在之前已经收缩过
+		for i := idx - 1; i >= 0; i-- {
+			if n.children[i] != nil {
+				if err := st.hash(n.children[i]); err != nil {
+					return err
+				}
+				break
+			}
+		}
+		if n.children[idx] == nil {
+			n.children[idx] = &stNode{kind: stEmpty, keyOffset: n.keyOffset + 1}
+		}
+		return st.insert(n.children[idx], hexKey, value)
+	case stExt:
+		diff := n.diffIndex(hexKey)
+		if diff == len(n.key) {
+			// key片段完全匹配，往子树里插
+			return st.insert(n.children[0], hexKey, value)
+		}
+		if n.keyOffset+diff >= len(hexKey) {
+			return errStackTriePrefixKey
+		}
+		// 在diff处分叉：原来的子树（key片段剩余的部分接一个新的拓展节点）挂到新的branchNode下，它不会再变，直接收缩
+		orig := n.children[0]
+		if diff < len(n.key)-1 {
+			orig = &stNode{kind: stExt, keyOffset: n.keyOffset + diff + 1, key: append([]byte{}, n.key[diff+1:]...)}
+			orig.children[0] = n.children[0]
+		}
+		if err := st.hash(orig); err != nil {
+			return err
+		}
+		branch := n
+		if diff == 0 {
+			// 第一个nibble就分叉，当前节点直接变成branchNode
+			n.kind = stBranch
+			n.children[0] = nil
+		} else {
+			branch = &stNode{kind: stBranch, keyOffset: n.keyOffset + diff}
+			n.children[0] = branch
+		}
+		branch.children[n.key[diff]] = orig
+		branch.children[hexKey[n.keyOffset+diff]] = newStLeaf(n.keyOffset+diff+1, hexKey[n.keyOffset+diff+1:], value)
+		n.key = n.key[:diff]
+		return nil
+	case stLeaf:
+		diff := n.diffIndex(hexKey)
+		if diff >= len(n.key) || n.keyOffset+diff >= len(hexKey) {
+			return errStackTriePrefixKey
+		}
+		// 在diff处分叉，diff为0时当前节点变成branchNode，否则变成拓展节点，下面接一个branchNode
+		branch := n
+		if diff == 0 {
+			n.kind = stBranch
+		} else {
+			n.kind = stExt
+			branch = &stNode{kind: stBranch, keyOffset: n.keyOffset + diff}
+			n.children[0] = branch
+		}
+		// 原来的叶子不会再变，直接收缩
+		orig := newStLeaf(n.keyOffset+diff+1, n.key[diff+1:], n.val)
+		if err := st.hash(orig); err != nil {
+			return err
+		}
+		branch.children[n.key[diff]] = orig
+		branch.children[hexKey[n.keyOffset+diff]] = newStLeaf(n.keyOffset+diff+1, hexKey[n.keyOffset+diff+1:], value)
+		n.key = n.key[:diff]
+		n.val = nil
+		return nil
+	case stEmpty:
+		n.kind = stLeaf
+		n.key = append([]byte{}, hexKey[n.keyOffset:]...)
+		n.val = value
+		return nil
+	default:
+		return errStackTrieKeyOrder
+	}
+}
+
+// 收缩：计算节点的rlp编码，不足32字节的保留编码本身（嵌入节点），否则做哈希并暂存等待Commit，子节点全部释放
+func (st *StackTrie) hash(n *stNode) error {
+	var items []interface{}
+	switch n.kind {
+	case stHashed:
+		return nil
+	case stBranch:
+		items = make([]interface{}, 17)
+		for i, child := range &n.children {
+			if child == nil {
+				items[i] = []byte{}
+				continue
+			}
+			if err := st.hash(child); err != nil {
+				return err
+			}
+			items[i] = child.reference()
+			n.children[i] = nil
+		}
+		items[16] = []byte{}
+	case stExt:
+		if err := st.hash(n.children[0]); err != nil {
+			return err
+		}
+		items = []interface{}{hex2hpe(n.key), n.children[0].reference()}
+		n.children[0] = nil
+	case stLeaf:
+		items = []interface{}{hex2hpe(append(n.key, HexLeafFlag)), n.val}
+	default:
+		return errors.New("invalid stack trie node")
+	}
+	h := newHasher(false)
+	defer returnHasherToPool(h)
+	h.tmp.Reset()
+	if err := rlp.Encode(&h.tmp, items); err != nil {
+		return err
+	}
+	n.kind, n.key = stHashed, nil
+	if len(h.tmp) < 32 {
+		n.val = common.CopyBytes(h.tmp)
+		return nil
+	}
+	n.val = h.hashData(h.tmp)
+	if st.db != nil {
+		st.pending = append(st.pending, stPending{n.val, common.CopyBytes(h.tmp)})
+	}
+	return nil
+}
+
+// 父节点编码时对子节点的引用：哈希值按字符串编码，嵌入节点原样写入
+func (n *stNode) reference() interface{} {
+	if len(n.val) < common.HashLength {
+		return rlp.RawValue(n.val)
+	}
+	return n.val
+}
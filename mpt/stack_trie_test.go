@@ -0,0 +1,138 @@
+package mpt
+
+import (
+	"bytes"
+	"ethereum-practice/mpt/database"
+	"ethereum-practice/rlp"
+	"math/rand"
+	"testing"
+)
+
+func TestStackTrieEmpty(t *testing.T) {
+	st := NewStackTrie(nil)
+	if root := st.Hash(); root != EmptyRoot {
+		t.Errorf("expected %x got %x", EmptyRoot, root)
+	}
+}
+
+func TestStackTrieAgainstMpt(t *testing.T) {
+	for _, n := range []int{1, 2, 3, 10, 100, 1000} {
+		mpt, vals := randomTrie(n)
+		st := NewStackTrie(nil)
+		for _, e := range sortedEntries(vals) {
+			if err := st.Insert(e.k, e.v); err != nil {
+				t.Fatalf("n=%d: insert %x error: %v", n, e.k, err)
+			}
+		}
+		if have, want := st.Hash(), mpt.Hash(); have != want {
+			t.Errorf("n=%d: root mismatch: have %x, want %x", n, have, want)
+		}
+	}
+}
+
+// 交易列表的key是rlp(index)，长度不一，value有长有短，覆盖嵌入节点和拓展节点分叉的情况
+func TestStackTrieDeriveSha(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	for _, n := range []int{1, 2, 16, 17, 128, 129, 300} {
+		mpt := newEmpty()
+		vals := make(map[string][]byte)
+		for i := 0; i < n; i++ {
+			key, _ := rlp.EncodeToBytes(uint(i))
+			value := make([]byte, 1+random.Intn(40))
+			random.Read(value)
+			mpt.Insert(key, value)
+			vals[string(key)] = value
+		}
+		st := NewStackTrie(nil)
+		for _, e := range sortedEntries(vals) {
+			if err := st.Insert(e.k, e.v); err != nil {
+				t.Fatalf("n=%d: insert %x error: %v", n, e.k, err)
+			}
+		}
+		if have, want := st.Hash(), mpt.Hash(); have != want {
+			t.Errorf("n=%d: root mismatch: have %x, want %x", n, have, want)
+		}
+	}
+}
+
+// Commit写出的节点要能被Mpt直接打开
+func TestStackTrieCommit(t *testing.T) {
+	_, vals := randomTrie(300)
+	diskdb := database.NewMemoryDatabase()
+	st := NewStackTrie(diskdb)
+	for _, e := range sortedEntries(vals) {
+		st.Insert(e.k, e.v)
+	}
+	root, err := st.Commit()
+	if err != nil {
+		t.Fatalf("commit error: %v", err)
+	}
+	mpt, err := NewWithDatabase(root, NewDatabaseWithStore(diskdb))
+	if err != nil {
+		t.Fatalf("reopen error: %v", err)
+	}
+	for k, v := range vals {
+		have, err := mpt.GetValue([]byte(k))
+		if err != nil {
+			t.Fatalf("get %x error: %v", k, err)
+		}
+		if !bytes.Equal(have, v) {
+			t.Fatalf("value mismatch for key %x: have %x, want %x", k, have, v)
+		}
+	}
+
+	// 只计算哈希时什么也不写，之后Commit才写入
+	diskdb = database.NewMemoryDatabase()
+	st = NewStackTrie(diskdb)
+	for _, e := range sortedEntries(vals) {
+		st.Insert(e.k, e.v)
+	}
+	if hash := st.Hash(); hash != root {
+		t.Fatalf("root mismatch: have %x want %x", hash, root)
+	}
+	if count, _ := storeSize(diskdb); count != 0 {
+		t.Fatalf("Hash wrote %d nodes", count)
+	}
+	if hash, err := st.Commit(); err != nil || hash != root {
+		t.Fatalf("commit after hash: %x, %v", hash, err)
+	}
+	if _, err := NewWithDatabase(root, NewDatabaseWithStore(diskdb)); err != nil {
+		t.Fatalf("reopen after hash and commit: %v", err)
+	}
+
+	// 根节点不足32字节时也要写入
+	diskdb = database.NewMemoryDatabase()
+	st = NewStackTrie(diskdb)
+	st.Insert([]byte{1}, []byte{2})
+	root, _ = st.Commit()
+	if _, err := diskdb.Get(root[:]); err != nil {
+		t.Errorf("small root not committed: %v", err)
+	}
+	if _, err := NewStackTrie(nil).Commit(); err != ErrCommitDisabled {
+		t.Errorf("expected ErrCommitDisabled, got %v", err)
+	}
+}
+
+func TestStackTrieKeyOrder(t *testing.T) {
+	st := NewStackTrie(nil)
+	if err := st.Insert([]byte("dog"), []byte("puppy")); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Insert([]byte("doe"), []byte("reindeer")); err != errStackTrieKeyOrder {
+		t.Errorf("out of order insert: expected %v, got %v", errStackTrieKeyOrder, err)
+	}
+	if err := st.Insert([]byte("dog"), []byte("puppy")); err != errStackTrieKeyOrder {
+		t.Errorf("duplicate insert: expected %v, got %v", errStackTrieKeyOrder, err)
+	}
+	if err := st.Insert([]byte("doge"), []byte("coin")); err != errStackTriePrefixKey {
+		t.Errorf("prefix insert: expected %v, got %v", errStackTriePrefixKey, err)
+	}
+	st.Hash()
+	if err := st.Insert([]byte("zebra"), []byte("stripes")); err != errStackTrieKeyOrder {
+		t.Errorf("insert after hash: expected %v, got %v", errStackTrieKeyOrder, err)
+	}
+	st.Reset()
+	if root := st.Hash(); root != EmptyRoot {
+		t.Errorf("expected %x after reset, got %x", EmptyRoot, root)
+	}
+}
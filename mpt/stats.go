@@ -0,0 +1,197 @@
+package mpt
+
+import (
+	"fmt"
+	"github.com/ethereum/go-ethereum/common"
+	"sort"
+	"strings"
+)
+
+/**
+树的形状统计，用来调整应用层key的设计、发现不合理的形状
+比如key没有做哈希、大量共享前缀时，会出现很长的拓展节点或者很深的树，这些都能从统计结果中直接看出来
+深度的定义：根节点深度为0，每经过一个节点（shortNode或branchNode）加1；嵌入节点与存储节点一样计算深度
+value的深度是它所在节点的深度：叶子shortNode的深度，或者branchNode第17项所在branchNode的深度
+编码字节数只统计单独存储的节点，嵌入节点的编码已经包含在父节点中
+*/
+
+// 最多记录这么多个最大的value
+const statsLargestValues = 10
+
+// 某一深度上的节点
+type LevelStats struct {
+	ShortNodes  uint64
+	BranchNodes uint64
+	Embedded    uint64 // 其中的嵌入节点数
+	Bytes       uint64 // 存储节点编码的总字节数
+}
+
+type ValueInfo struct {
+	Key  []byte // 完整的key；树的结构不合法、路径为奇数个nibble时为nil
+	Path []byte // hex路径，不含判断位
+	Size int
+}
+
+type TrieStats struct {
+	Stored     uint64 // 单独存储的节点数
+	Embedded   uint64 // 嵌入节点数
+	Extensions uint64 // 拓展节点（非叶子的shortNode）数
+	Leaves     uint64 // 叶子节点（value在shortNode中）数
+	Branches   uint64 // branchNode数
+	Values     uint64 // value总数（叶子节点加上带value的branchNode），即key的个数
+	ValueBytes uint64 // value的总字节数
+	Bytes      uint64 // 存储节点编码的总字节数
+
+	Levels           []LevelStats // 下标为深度
+	ValueDepths      []uint64     // value深度的分布，下标为深度
+	FanOut           [17]uint64   // branchNode子节点个数（不含value）的分布
+	BranchValues     uint64       // 带value的branchNode数
+	ExtensionLengths []uint64     // 拓展节点key长度（nibble数）的分布
+	Largest          []ValueInfo  // 最大的若干个value，从大到小
+}
+
+// 统计root下的整棵树，节点从db中读取（包括还没有落盘的dirties），遇到缺失或损坏的节点时返回错误
+func Stats(db *Database, root common.Hash) (*TrieStats, error) {
+	stats := &TrieStats{}
+	if root == (common.Hash{}) || root == EmptyRoot {
+		return stats, nil
+	}
+	if err := stats.walk(db, hashedNode(root[:]), nil, 0, false); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+func (s *TrieStats) level(depth int) *LevelStats {
+	for len(s.Levels) <= depth {
+		s.Levels = append(s.Levels, LevelStats{})
+	}
+	return &s.Levels[depth]
+}
+
+// 给分布的第index项加1，长度不够时补齐
+func countAt(histogram []uint64, index int) []uint64 {
+	for len(histogram) <= index {
+		histogram = append(histogram, 0)
+	}
+	histogram[index]++
+	return histogram
+}
+
+// embedded表示n是嵌入在父节点中的节点
+func (s *TrieStats) walk(db *Database, n node, path []byte, depth int, embedded bool) error {
+	if hash, ok := n.(hashedNode); ok {
+		// 与resolveHash相同，只是顺便拿到编码的大小
+		blob, err := db.node(common.BytesToHash(hash))
+		if err != nil {
+			return fmt.Errorf("failed to read trie node %x (path %x): %w", hash, path, err)
+		}
+		if len(blob) == 0 {
+			return &MissingNodeError{NodeHash: common.BytesToHash(hash), Path: common.CopyBytes(path)}
+		}
+		decoded, err := decodeNode(hash, blob)
+		if err != nil {
+			return &CorruptNodeError{NodeHash: common.BytesToHash(hash), Path: common.CopyBytes(path), Blob: blob, Err: err}
+		}
+		s.Stored++
+		s.Bytes += uint64(len(blob))
+		s.level(depth).Bytes += uint64(len(blob))
+		n = decoded
+	} else if embedded {
+		s.Embedded++
+		s.level(depth).Embedded++
+	}
+	switch n := n.(type) {
+	case *shortNode:
+		s.level(depth).ShortNodes++
+		if isLeaf(n.Key) {
+			s.Leaves++
+			value, _ := n.Value.(valueNode)
+			s.addValue(concat(path, n.Key[:len(n.Key)-1]), value, depth)
+			return nil
+		}
+		s.Extensions++
+		s.ExtensionLengths = countAt(s.ExtensionLengths, len(n.Key))
+		if n.Value == nil {
+			return nil
+		}
+		return s.walk(db, n.Value, concat(path, n.Key), depth+1, true)
+	case *branchNode:
+		s.level(depth).BranchNodes++
+		s.Branches++
+		children := 0
+		for i := 0; i < 16; i++ {
+			if child := n.Children[i]; child != nil {
+				children++
+				if err := s.walk(db, child, concat(path, []byte{byte(i)}), depth+1, true); err != nil {
+					return err
+				}
+			}
+		}
+		s.FanOut[children]++
+		if value, ok := n.Children[16].(valueNode); ok {
+			s.BranchValues++
+			s.addValue(path, value, depth)
+		}
+	}
+	return nil
+}
+
+func (s *TrieStats) addValue(path []byte, value valueNode, depth int) {
+	s.Values++
+	s.ValueBytes += uint64(len(value))
+	s.ValueDepths = countAt(s.ValueDepths, depth)
+
+	// 按大小从大到小保持有序，大小相同的先到先得
+	i := sort.Search(len(s.Largest), func(i int) bool { return s.Largest[i].Size < len(value) })
+	if i >= statsLargestValues {
+		return
+	}
+	info := ValueInfo{Path: common.CopyBytes(path), Size: len(value)}
+	if len(path)%2 == 0 {
+		info.Key = hex2key(path)
+	}
+	s.Largest = append(s.Largest, ValueInfo{})
+	copy(s.Largest[i+1:], s.Largest[i:])
+	s.Largest[i] = info
+	if len(s.Largest) > statsLargestValues {
+		s.Largest = s.Largest[:statsLargestValues]
+	}
+}
+
+// 可读的报告
+func (s *TrieStats) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "values: %d (%d bytes), in leaves: %d, in branches: %d\n", s.Values, s.ValueBytes, s.Leaves, s.BranchValues)
+	fmt.Fprintf(&b, "nodes: %d short (%d extensions), %d branch; %d stored (%d bytes), %d embedded\n",
+		s.Extensions+s.Leaves, s.Extensions, s.Branches, s.Stored, s.Bytes, s.Embedded)
+	fmt.Fprintf(&b, "%-6s %10s %10s %10s %12s %10s\n", "depth", "short", "branch", "embedded", "bytes", "values")
+	for depth, level := range s.Levels {
+		var values uint64
+		if depth < len(s.ValueDepths) {
+			values = s.ValueDepths[depth]
+		}
+		fmt.Fprintf(&b, "%-6d %10d %10d %10d %12d %10d\n", depth, level.ShortNodes, level.BranchNodes, level.Embedded, level.Bytes, values)
+	}
+	b.WriteString("branch fan-out:")
+	for children, count := range s.FanOut {
+		if count > 0 {
+			fmt.Fprintf(&b, " %d:%d", children, count)
+		}
+	}
+	b.WriteString("\nextension key length:")
+	for length, count := range s.ExtensionLengths {
+		if count > 0 {
+			fmt.Fprintf(&b, " %d:%d", length, count)
+		}
+	}
+	b.WriteString("\nlargest values:\n")
+	for _, v := range s.Largest {
+		if v.Key != nil {
+			fmt.Fprintf(&b, "  key %x: %d bytes\n", v.Key, v.Size)
+		} else {
+			fmt.Fprintf(&b, "  path %x: %d bytes\n", v.Path, v.Size)
+		}
+	}
+	return b.String()
+}
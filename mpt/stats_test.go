@@ -0,0 +1,122 @@
+package mpt
+
+import (
+	"bytes"
+	"ethereum-practice/mpt/database"
+	"reflect"
+	"testing"
+)
+
+// 形状已知的小树，TestStats和dump的测试共用
+//
+//	root: branch，value为key ""，子节点：
+//	  0: branch -> 0x00, 0x01
+//	  1: leaf 0x10
+//	  2: leaf 0x20（嵌入）
+//	  3: extension [0,0] -> branch -> 0x3000, 0x3001
+func shapeTestTrie() *Mpt {
+	mpt := newEmpty()
+	keys := [][]byte{{}, {0x00}, {0x01}, {0x10}, {0x20}, {0x30, 0x00}, {0x30, 0x01}}
+	for i, key := range keys {
+		// value各不相同的长度，0x20的value很短，会被嵌入
+		value := bytes.Repeat([]byte{byte(i)}, 40+i)
+		if bytes.Equal(key, []byte{0x20}) {
+			value = []byte("x")
+		}
+		mpt.Insert(key, value)
+	}
+	return mpt
+}
+
+func TestStats(t *testing.T) {
+	diskdb := database.NewMemoryDatabase()
+	mpt := shapeTestTrie()
+	root := commitToStore(t, diskdb, mpt.root)
+
+	stats, err := Stats(NewDatabaseWithStore(diskdb), root)
+	if err != nil {
+		t.Fatalf("stats error: %v", err)
+	}
+	if stats.Stored != 9 || stats.Embedded != 1 || stats.Extensions != 1 || stats.Leaves != 6 || stats.Branches != 3 || stats.Values != 7 || stats.BranchValues != 1 {
+		t.Errorf("unexpected counts: %+v", stats)
+	}
+	if count, size := storeSize(diskdb); stats.Stored != count || stats.Bytes != size-32*count {
+		t.Errorf("bytes mismatch: have %d nodes %d bytes, store has %d keys %d bytes", stats.Stored, stats.Bytes, count, size)
+	}
+	for i := range stats.Levels {
+		stats.Levels[i].Bytes = 0
+	}
+	levels := []LevelStats{
+		{BranchNodes: 1},
+		{ShortNodes: 3, BranchNodes: 1, Embedded: 1},
+		{ShortNodes: 2, BranchNodes: 1},
+		{ShortNodes: 2},
+	}
+	if !reflect.DeepEqual(stats.Levels, levels) {
+		t.Errorf("levels mismatch: have %+v want %+v", stats.Levels, levels)
+	}
+	if want := []uint64{1, 2, 2, 2}; !reflect.DeepEqual(stats.ValueDepths, want) {
+		t.Errorf("value depths mismatch: have %v want %v", stats.ValueDepths, want)
+	}
+	if want := [17]uint64{2: 2, 4: 1}; stats.FanOut != want {
+		t.Errorf("fan-out mismatch: have %v want %v", stats.FanOut, want)
+	}
+	if want := []uint64{0, 0, 1}; !reflect.DeepEqual(stats.ExtensionLengths, want) {
+		t.Errorf("extension lengths mismatch: have %v want %v", stats.ExtensionLengths, want)
+	}
+	// 从大到小：0x3001, 0x3000, 0x10, 0x01, 0x00, ""，然后是0x20
+	want := []ValueInfo{
+		{[]byte{0x30, 0x01}, []byte{3, 0, 0, 1}, 46},
+		{[]byte{0x30, 0x00}, []byte{3, 0, 0, 0}, 45},
+		{[]byte{0x10}, []byte{1, 0}, 43},
+		{[]byte{0x01}, []byte{0, 1}, 42},
+		{[]byte{0x00}, []byte{0, 0}, 41},
+		{[]byte{}, nil, 40},
+		{[]byte{0x20}, []byte{2, 0}, 1},
+	}
+	if !reflect.DeepEqual(stats.Largest, want) {
+		t.Errorf("largest values mismatch: have %v want %v", stats.Largest, want)
+	}
+}
+
+func TestStatsRandom(t *testing.T) {
+	mpt, vals := randomTrie(500)
+	// 不落盘，直接从dirties中读取
+	root, _ := mpt.Commit()
+	stats, err := Stats(mpt.Database(), root)
+	if err != nil {
+		t.Fatalf("stats error: %v", err)
+	}
+	var valueBytes uint64
+	var largest int
+	for _, v := range vals {
+		valueBytes += uint64(len(v))
+		if len(v) > largest {
+			largest = len(v)
+		}
+	}
+	if stats.Values != uint64(len(vals)) || stats.ValueBytes != valueBytes {
+		t.Errorf("have %d values (%d bytes), want %d (%d bytes)", stats.Values, stats.ValueBytes, len(vals), valueBytes)
+	}
+	if nodes, _ := mpt.Database().Size(); stats.Stored != uint64(nodes) {
+		t.Errorf("have %d stored nodes, database has %d", stats.Stored, nodes)
+	}
+	if len(stats.Largest) != statsLargestValues || stats.Largest[0].Size != largest {
+		t.Errorf("unexpected largest values: %v", stats.Largest)
+	}
+	for _, v := range stats.Largest {
+		if len(vals[string(v.Key)]) != v.Size {
+			t.Errorf("largest value %x: have size %d, want %d", v.Key, v.Size, len(vals[string(v.Key)]))
+		}
+	}
+	if stats.String() == "" {
+		t.Errorf("empty report")
+	}
+
+	// 缺失节点时报错
+	if _, err := Stats(NewDatabase(), root); err == nil {
+		t.Errorf("no error for missing root")
+	} else if _, ok := err.(*MissingNodeError); !ok {
+		t.Errorf("unexpected error type %T: %v", err, err)
+	}
+}
@@ -0,0 +1,12 @@
+#!/bin/sh
+# 从ethereum/tests下载TrieTests的原文件，覆盖这个目录下的摘录，不做任何修改
+# 用法：sh mpt/testdata/TrieTests/fetch.sh [ref]，ref默认为develop
+set -e
+ref=${1:-develop}
+dir=$(dirname "$0")
+for f in trietest.json trietest_secureTrie.json trieanyorder.json trieanyorder_secureTrie.json \
+	hex_encoded_securetrie_test.json trietestnextprev.json; do
+	# 先下载到临时文件，失败时不会留下不完整的文件
+	curl -sSfL -o "$dir/$f.tmp" "https://raw.githubusercontent.com/ethereum/tests/$ref/TrieTests/$f"
+	mv "$dir/$f.tmp" "$dir/$f"
+done
@@ -3,7 +3,7 @@ package mpt
 /*
 实现mpt树，对一部分功能做简化处理，先考虑核心逻辑的实现：
 	1.database用map替代，不依赖leveldb，实际上就是源码中的memorydb的做法
-	2.节点缓存功能暂不实现，主要影响由key查找相应节点的实现——拿掉缓存之后，直接到db中找
+	2.节点缓存默认不开启，由key查找相应节点时直接到db中找；可以通过Config.Cache开启clean缓存
 	3.rlp编码，暂时先用源码提供的
 	4.sha3系列算法暂时使用源码提供的
 
@@ -11,6 +11,7 @@ package mpt
 
 import (
 	"bytes"
+	"ethereum-practice/rlp"
 	"fmt"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/crypto"
@@ -25,11 +26,24 @@ var (
 type Mpt struct {
 	db *Database
 	root node
+	snapshots []node // Snapshot时的根节点，下标即快照id
 }
 
+// 需要重新计算哈希的节点达到这个数量才并行计算
+const parallelHashThreshold = 100
 
+
+// 使用私有的内存数据库
 func New(root common.Hash) (*Mpt, error){
-	mpt := &Mpt{db:NewDatabase()}
+	return NewWithDatabase(root, NewDatabase())
+}
+
+// 使用共享的Database，可以打开其中任意一个已提交的root，多棵树（比如各个账户的storage树）可以共用一个Database
+func NewWithDatabase(root common.Hash, db *Database) (*Mpt, error){
+	if db == nil {
+		panic("mpt.NewWithDatabase called without a database")
+	}
+	mpt := &Mpt{db:db}
 	// 提供root时从数据库中加载
 	if root != (common.Hash{}) && root != EmptyRoot {
 		rn, err := mpt.resolveHashedNode(root[:], nil)
@@ -42,6 +56,10 @@ func New(root common.Hash) (*Mpt, error){
 }
 
 
+func (t *Mpt) Database() *Database {
+	return t.db
+}
+
 func (t *Mpt) resolveHash(hash common.Hash, prefix []byte) (node, error) {
 	return resolveHash(t.db, hash, prefix)
 }
@@ -118,22 +136,82 @@ func (t *Mpt) getValueByHex(root node, hexKey []byte, keyBias int) (value []byte
 	}
 }
 
-func (t *Mpt) GetNode(hpeKey []byte) []byte {
-	panic("not implemented")
+// 按hpe格式的路径查找节点，返回节点的rlp编码，以及查找过程中从数据库解析的节点数
+// 路径上没有节点时返回nil
+func (t *Mpt) GetNode(hpeKey []byte) ([]byte, int, error) {
+	item, resolvedNode, resolved, err := t.getNodeByHex(t.root, hpe2hex(hpeKey), 0)
+	if err != nil {
+		return nil, resolved, err
+	}
+	if resolved > 0 {
+		t.root = resolvedNode
+	}
+	return item, resolved, nil
 }
 
-func (t *Mpt) getNodeByHex(root node, hexKey []byte, keyBias int) (n node, newRoot node, resolved int, err error) {
-	panic("not implemented")
+// 输入参数：
+// root：查询的根节点；hexKey：查询的路径（hex encoding）；keyBias，当前比较路径的起始位置
+// 输出：
+// item：节点的rlp编码；newRoot：替换root的节点（hashedNode被解析之后的结果）；resolved：从数据库解析的节点数
+func (t *Mpt) getNodeByHex(root node, hexKey []byte, keyBias int) (item []byte, newRoot node, resolved int, err error) {
+	// 路径已经走完，当前节点就是要找的节点；hashedNode还需要先解析出来（走下面的hashedNode分支）
+	if keyBias >= len(hexKey) {
+		switch nd := root.(type) {
+		case *shortNode, *branchNode:
+			// 折叠子节点后编码，与数据库中保存的编码一致
+			h := newHasher(false)
+			defer returnHasherToPool(h)
+			collapsed, _ := h.proofHash(nd)
+			enc, err := rlp.EncodeToBytes(collapsed)
+			return enc, nd, 0, err
+		case valueNode:
+			// 路径包含叶子判断位时会停在value上，与源码一致返回value的rlp编码
+			enc, err := rlp.EncodeToBytes(nd)
+			return enc, nd, 0, err
+		}
+	}
+	switch nd := root.(type) {
+	case *shortNode:
+		if len(hexKey)-keyBias < len(nd.Key) || !nd.EqualsKey(hexKey, keyBias) {
+			return nil, nd, 0, nil
+		}
+		item, resolvedNode, resolved, err := t.getNodeByHex(nd.Value, hexKey, keyBias+len(nd.Key))
+		if err == nil && resolved > 0 {
+			nd = nd.copy()
+			nd.Value = resolvedNode
+		}
+		return item, nd, resolved, err
+	case *branchNode:
+		item, resolvedNode, resolved, err := t.getNodeByHex(nd.Children[hexKey[keyBias]], hexKey, keyBias+1)
+		if err == nil && resolved > 0 {
+			nd = nd.copy()
+			nd.Children[hexKey[keyBias]] = resolvedNode
+		}
+		return item, nd, resolved, err
+	case hashedNode:
+		decodedNode, err := t.resolveHashedNode(nd, hexKey[:keyBias])
+		if err != nil {
+			return nil, nd, 1, err
+		}
+		item, resolvedNode, resolved, err := t.getNodeByHex(decodedNode, hexKey, keyBias)
+		return item, resolvedNode, resolved + 1, err
+	case valueNode, nil:
+		// 路径提前结束或者不存在
+		return nil, nd, 0, nil
+	default:
+		panic(fmt.Sprintf("errors occurs when processing node: %v", root))
+	}
 }
 
-//
+// 与源码的Update一致，value为空时相当于Delete
 func (t *Mpt) Insert(key, value []byte) error {
-	hexKey := key2hex(key)
-	if len(value) != 0 {
-		_, root, err := t.insert(t.root, valueNode(value), hexKey, nil)
-		if err != nil {return err}
-		t.root = root
+	if len(value) == 0 {
+		return t.Delete(key)
 	}
+	hexKey := key2hex(key)
+	_, root, err := t.insert(t.root, valueNode(value), hexKey, nil)
+	if err != nil {return err}
+	t.root = root
 	return nil
 }
 
@@ -152,7 +230,7 @@ func (t *Mpt) insert(root, value node, hexKey, prefix []byte) (isChanged bool, r
 	switch nRoot := root.(type) {
 	case *branchNode:
 		isChanged, rn, err := t.insert(nRoot.Children[hexKey[0]], value, hexKey[1:], append(prefix, hexKey[0]))
-		if !isChanged || err != nil {return false, rn, err}
+		if !isChanged || err != nil {return false, nRoot, err}
 		// 刷新当前节点，子树插入新元素，hash值会变（如果有缓存的话）
 		nRoot = nRoot.copy()
 		nRoot.status = nodeStatus{dirty: true}
@@ -164,7 +242,7 @@ func (t *Mpt) insert(root, value node, hexKey, prefix []byte) (isChanged bool, r
 		if matchedLength == len(nRoot.Key) {
 			isChanged, rn, err = t.insert(nRoot.Value, value, hexKey[matchedLength:], append(prefix, hexKey[:matchedLength]...))
 			if !isChanged || err != nil {
-				return false, rn, err
+				return false, nRoot, err
 			}
 			return true, &shortNode{nRoot.Key, rn, nodeStatus{dirty:true}}, nil
 		}
@@ -176,6 +254,7 @@ func (t *Mpt) insert(root, value node, hexKey, prefix []byte) (isChanged bool, r
 		if err != nil {return false, nil, err}
 		// 新节点插入
 		_, branch.Children[hexKey[matchedLength]], err = t.insert(nil, value, hexKey[matchedLength+1:], append(prefix, hexKey[:matchedLength+1]...))
+		if err != nil {return false, nil, err}
 		// 用新的branchNode替换掉shortNode；如果key完全不重合，就是一个branchNode，否则需要增加一个拓展节点表示公共部分
 		if matchedLength == 0 {return true, branch, nil}
 		return true, &shortNode{hexKey[:matchedLength], branch, nodeStatus{dirty:true}}, nil
@@ -223,7 +302,7 @@ func (t *Mpt) delete(root node, prefix, hexKey []byte) (isChanged bool, rn node,
 		isChanged, rn, err := t.delete(nRoot.Children[hexKey[0]], append(prefix, hexKey[0]), hexKey[1:])
 		// 未修改/出错
 		if !isChanged || err != nil {
-			return false, rn, err
+			return false, nRoot, err
 		}
 		// 成功修改，更新当前根节点
 		nRoot = nRoot.copy()
@@ -231,7 +310,8 @@ func (t *Mpt) delete(root node, prefix, hexKey []byte) (isChanged bool, rn node,
 		nRoot.Children[hexKey[0]] = rn
 		// branchNode理论上是16叉树，如果删除把子节点干掉只剩一个，就需要调整树的结构了
 		// 首先要确定到底有几个子节点，如果只有一个，它的位置又是多少
-		// -10：16个节点全满；-2：有2个及以上的非空节点；正数[0,15]：仅剩一个非空节点；正数16：16个节点都是空的，但value非空
+		// -10：没有非空节点（删除之前至少有两个，不会出现）；-2：有2个及以上的非空节点；正数[0,15]：仅剩一个非空节点；
+		// 16：16个子节点都是空的，只剩下value（被删除的key以它为前缀），收缩成只有判断位的叶子节点
 		loc := -10
 		for i, child := range &nRoot.Children {
 			if nil != child {
@@ -247,7 +327,7 @@ func (t *Mpt) delete(root node, prefix, hexKey []byte) (isChanged bool, rn node,
 			// 如果子节点是hashedNode还需要到数据库中读取
 			var childNode node
 			if hashedRoot, ok := nRoot.Children[loc].(hashedNode); ok {
-				cn, err := t.resolveHashedNode(hashedRoot, prefix)
+				cn, err := t.resolveHashedNode(hashedRoot, append(prefix, byte(loc)))
 				if err != nil {
 					return false, nil, err
 				}
@@ -259,7 +339,7 @@ func (t *Mpt) delete(root node, prefix, hexKey []byte) (isChanged bool, rn node,
 			if childNode, ok := childNode.(*shortNode); ok {
 				newKey := append([]byte{byte(loc)}, childNode.Key...)
 				return true, &shortNode{newKey, childNode.Value, nodeStatus{dirty: true}}, nil
-			} else {           							// 如果子节点是其他类型，todo check this branch
+			} else {           							// 子节点是branchNode，保留它，前面接一个只有一位的拓展节点
 				return true, &shortNode{[]byte{byte(loc)}, nRoot.Children[loc], nodeStatus{dirty: true}}, nil
 			}
 		} else if loc == 16 { 						// 变成叶子节点
@@ -303,4 +383,100 @@ func (t *Mpt) delete(root node, prefix, hexKey []byte) (isChanged bool, rn node,
 	}
 }
 
-// todo 计算Hash值
+// 计算根节点的哈希值，空树返回EmptyRoot
+// 计算完成后用带哈希缓存的节点替换原来的树，未修改的子树下次不再重复计算
+func (t *Mpt) Hash() common.Hash {
+	hash, cached := t.hashRoot()
+	t.root = cached
+	return common.BytesToHash(hash.(hashedNode))
+}
+
+func (t *Mpt) hashRoot() (node, node) {
+	if t.root == nil {
+		return hashedNode(EmptyRoot.Bytes()), nil
+	}
+	h := newHasher(countDirty(t.root, parallelHashThreshold) >= parallelHashThreshold)
+	defer returnHasherToPool(h)
+	return h.hash(t.root, true)
+}
+
+// 数出没有哈希缓存（需要重新计算）的节点，数到limit就停下，所以代价最多是limit个节点
+// 有缓存的节点下面不会再有需要计算的节点（修改时沿途的节点都换成了新的），不必往下走
+// 状态都在节点本身上，RevertToSnapshot换回旧的根节点之后，数出来的也是旧树的情况
+func countDirty(n node, limit int) int {
+	count := 0
+	switch n := n.(type) {
+	case *shortNode:
+		if n.status.hash != nil {
+			return 0
+		}
+		count++
+		if count < limit {
+			count += countDirty(n.Value, limit-count)
+		}
+	case *branchNode:
+		if n.status.hash != nil {
+			return 0
+		}
+		count++
+		for i := 0; i < 16 && count < limit; i++ {
+			if n.Children[i] != nil {
+				count += countDirty(n.Children[i], limit-count)
+			}
+		}
+	}
+	return count
+}
+
+// 把dirty的节点交给Database，返回新的根哈希
+// 提交之后根节点被替换成hashedNode，后续访问时从Database中按需解析
+// 节点只是进入Database的dirties（内存），底层存储中什么也没有写；必须再调用Database.Commit(root)才会落盘
+func (t *Mpt) Commit() (common.Hash, error) {
+	if t.root == nil {
+		return EmptyRoot, nil
+	}
+	rootHash := t.Hash()
+	committed, err := newCommitter(t.db).commit(t.root)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	t.root = committed
+	return rootHash, nil
+}
+
+// 复制一棵树，与原树共享所有节点和Database
+// 节点一旦创建就不会被修改（见insert/delete中的copy()），所以两边各自的修改互不可见，也可以分别交给不同的goroutine使用
+func (t *Mpt) Copy() *Mpt {
+	return &Mpt{
+		db:        t.db,
+		root:      t.root,
+		snapshots: append([]node(nil), t.snapshots...),
+	}
+}
+
+/**
+快照与回滚
+insert/delete都不修改原有节点，沿途的节点先copy()再修改（copy-on-write），旧的根节点所代表的整棵树始终保持不变
+所以快照只需要记住当时的根节点，回滚时换回来即可，不需要记录每个key的旧值，也不需要重新读数据库
+未修改的子树在新旧根之间共享，保留多个快照的额外内存只有被修改路径上的节点
+*/
+
+// 记录当前状态，返回快照id
+func (t *Mpt) Snapshot() int {
+	t.snapshots = append(t.snapshots, t.root)
+	return len(t.snapshots) - 1
+}
+
+// 回滚到id对应的快照，id以及之后创建的快照全部失效
+func (t *Mpt) RevertToSnapshot(id int) {
+	if id < 0 || id >= len(t.snapshots) {
+		panic(fmt.Sprintf("snapshot id %d cannot be reverted", id))
+	}
+	t.root = t.snapshots[id]
+	t.snapshots = t.snapshots[:id]
+}
+
+// 丢弃所有快照，之后不能再回滚
+func (t *Mpt) DiscardSnapshots() {
+	t.snapshots = nil
+}
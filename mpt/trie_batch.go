@@ -0,0 +1,239 @@
+package mpt
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+/**
+批量修改
+逐个Insert时，每个key都要从根节点走一遍，N个key就要把上层的节点重建N次
+UpdateBatch先把key排好序，再做一次递归下降：在每个节点上把落在同一个子树中的key分成一组，一起交给子树处理
+	==> 共同前缀上的节点只访问、只复制一次；哈希仍然推迟到Hash/Commit时统一计算
+value为空表示删除。同一个key出现多次时以最后一次为准
+处理规则与insert/delete一致，结果（包括根哈希）与逐个Insert/Delete完全相同
+*/
+
+var errBatchLength = errors.New("keys and values must have the same length")
+
+// 一条待处理的修改，key为完整的hex编码（含判断位）
+// 递归时不截断key，只传递已处理的位数pos，已处理的部分key[:pos]就是当前节点的路径，不需要另外分配prefix
+type batchEntry struct {
+	key   []byte
+	value valueNode // nil表示删除
+	order int       // 在参数中的位置，key相同时以位置靠后的为准
+}
+
+// 按key排序，key相同时按参数中的位置排序
+type batchEntries []batchEntry
+
+func (s batchEntries) Len() int      { return len(s) }
+func (s batchEntries) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s batchEntries) Less(i, j int) bool {
+	if c := bytes.Compare(s[i].key, s[j].key); c != 0 {
+		return c < 0
+	}
+	return s[i].order < s[j].order
+}
+
+func (t *Mpt) UpdateBatch(keys, values [][]byte) error {
+	if len(keys) != len(values) {
+		return errBatchLength
+	}
+	entries := make(batchEntries, len(keys))
+	for i := range keys {
+		entries[i] = batchEntry{key: key2hex(keys[i]), order: i}
+		if len(values[i]) != 0 {
+			entries[i].value = valueNode(values[i])
+		}
+	}
+	// 相同的key保留最后一个
+	sort.Sort(entries)
+	deduped := entries[:0]
+	for i, entry := range entries {
+		if i+1 < len(entries) && bytes.Equal(entry.key, entries[i+1].key) {
+			continue
+		}
+		deduped = append(deduped, entry)
+	}
+	changed, root, err := t.updateBatch(t.root, 0, deduped)
+	if err != nil {
+		return err
+	}
+	if changed {
+		t.root = root
+	}
+	return nil
+}
+
+// 输入参数
+// root：当前子树的根节点；pos：已处理的key的位数；entries：落在这棵子树中的修改，按key排好序，key[:pos]都相同
+// 输出参数
+// isChanged：子树是否有变化；rn：修改后的子树，可能为nil（子树被删空）
+func (t *Mpt) updateBatch(root node, pos int, entries []batchEntry) (isChanged bool, rn node, err error) {
+	if len(entries) == 0 {
+		return false, root, nil
+	}
+	// 限制容量，append时不会覆盖key后面的部分
+	prefix := entries[0].key[:pos:pos]
+	switch nRoot := root.(type) {
+	case nil:
+		return t.buildBatch(pos, entries)
+	case valueNode:
+		// 带判断位的key各不相同，走到value时只可能剩下一个空key
+		if value := entries[0].value; value != nil {
+			return !bytes.Equal(nRoot, value), value, nil
+		}
+		return true, nil, nil
+	case hashedNode:
+		decodedNode, err := t.resolveHashedNode(nRoot, prefix)
+		if err != nil {
+			return false, nil, err
+		}
+		isChanged, rn, err := t.updateBatch(decodedNode, pos, entries)
+		if !isChanged || err != nil {
+			return false, nRoot, err
+		}
+		return true, rn, nil
+	case *shortNode:
+		// 所有key与Key的最短公共前缀
+		matchedLength := len(nRoot.Key)
+		for _, entry := range entries {
+			if l := commonKeyLength(entry.key[pos:], nRoot.Key); l < matchedLength {
+				matchedLength = l
+			}
+		}
+		if matchedLength == len(nRoot.Key) {
+			isChanged, rn, err := t.updateBatch(nRoot.Value, pos+len(nRoot.Key), entries)
+			if !isChanged || err != nil {
+				return false, nRoot, err
+			}
+			return true, t.newShortNode(nRoot.Key, rn), nil
+		}
+		// 有key在matchedLength处分叉，先把shortNode展开成等价的 shortNode(公共部分) + branchNode，再在展开后的结构上处理
+		branch := &branchNode{status: nodeStatus{dirty: true}}
+		if rest := nRoot.Key[matchedLength+1:]; len(rest) == 0 {
+			branch.Children[nRoot.Key[matchedLength]] = nRoot.Value
+		} else {
+			branch.Children[nRoot.Key[matchedLength]] = &shortNode{rest, nRoot.Value, nodeStatus{dirty: true}}
+		}
+		shared := nRoot.Key[:matchedLength]
+		isChanged, rn, err := t.updateBatch(branch, pos+matchedLength, entries)
+		// 分叉出去的key全是删除（要删的key本来就不存在）时没有变化，保留原节点
+		if !isChanged || err != nil {
+			return false, nRoot, err
+		}
+		return true, t.newShortNode(shared, rn), nil
+	case *branchNode:
+		var branch *branchNode
+		for start := 0; start < len(entries); {
+			// 第一个nibble相同的key分成一组
+			loc := entries[start].key[pos]
+			end := start + 1
+			for end < len(entries) && entries[end].key[pos] == loc {
+				end++
+			}
+			isChanged, rn, err := t.updateBatch(nRoot.Children[loc], pos+1, entries[start:end])
+			if err != nil {
+				return false, nRoot, err
+			}
+			if isChanged {
+				if branch == nil {
+					branch = nRoot.copy()
+					branch.status = nodeStatus{dirty: true}
+				}
+				branch.Children[loc] = rn
+			}
+			start = end
+		}
+		if branch == nil {
+			return false, nRoot, nil
+		}
+		rn, err := t.normalizeBranch(branch, prefix)
+		return true, rn, err
+	default:
+		panic(fmt.Sprintf("errors occurs when processing node: %v", root))
+	}
+}
+
+// 在空位置上构造一棵只包含entries的子树，删除操作直接忽略
+func (t *Mpt) buildBatch(pos int, entries []batchEntry) (isChanged bool, rn node, err error) {
+	inserts := entries
+	for i, entry := range entries {
+		if entry.value == nil {
+			// 有删除操作时才复制一份
+			inserts = append(make([]batchEntry, 0, len(entries)), entries[:i]...)
+			for _, entry := range entries[i+1:] {
+				if entry.value != nil {
+					inserts = append(inserts, entry)
+				}
+			}
+			break
+		}
+	}
+	switch len(inserts) {
+	case 0:
+		return false, nil, nil
+	case 1:
+		// key已经走完（落在branchNode的value位置上），直接就是value
+		if len(inserts[0].key) == pos {
+			return true, inserts[0].value, nil
+		}
+		return true, &shortNode{inserts[0].key[pos:], inserts[0].value, nodeStatus{dirty: true}}, nil
+	}
+	// 至少两个key，它们的公共前缀（排好序时就是首尾两个的公共前缀）成为拓展节点，之后分叉成branchNode
+	matchedLength := commonKeyLength(inserts[0].key[pos:], inserts[len(inserts)-1].key[pos:])
+	_, rn, err = t.updateBatch(&branchNode{status: nodeStatus{dirty: true}}, pos+matchedLength, inserts)
+	if err != nil {
+		return false, nil, err
+	}
+	return true, t.newShortNode(inserts[0].key[pos:pos+matchedLength], rn), nil
+}
+
+// 构造key -> child的shortNode，保证结构合法：key为空时就是child本身，child为nil时整个节点消失，
+// child是shortNode时两段key合并
+func (t *Mpt) newShortNode(key []byte, child node) node {
+	if child == nil {
+		return nil
+	}
+	if len(key) == 0 {
+		return child
+	}
+	if short, ok := child.(*shortNode); ok {
+		return &shortNode{concat(key, short.Key), short.Value, nodeStatus{dirty: true}}
+	}
+	return &shortNode{append([]byte{}, key...), child, nodeStatus{dirty: true}}
+}
+
+// branchNode的子节点被删除之后调整结构，规则与delete相同：
+// 一个子节点都不剩时整个节点消失；只剩一个时收缩成shortNode，子节点本身是shortNode的还要合并
+func (t *Mpt) normalizeBranch(n *branchNode, prefix []byte) (node, error) {
+	loc, count := -1, 0
+	for i, child := range &n.Children {
+		if child != nil {
+			loc = i
+			count++
+		}
+	}
+	switch {
+	case count == 0:
+		return nil, nil
+	case count > 1:
+		return n, nil
+	case loc == 16:
+		return &shortNode{[]byte{byte(loc)}, n.Children[loc], nodeStatus{dirty: true}}, nil
+	}
+	child := n.Children[loc]
+	if hashed, ok := child.(hashedNode); ok {
+		resolved, err := t.resolveHashedNode(hashed, append(prefix, byte(loc)))
+		if err != nil {
+			return nil, err
+		}
+		if short, ok := resolved.(*shortNode); ok {
+			child = short
+		}
+	}
+	return t.newShortNode([]byte{byte(loc)}, child), nil
+}
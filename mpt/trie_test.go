@@ -0,0 +1,899 @@
+package mpt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"ethereum-practice/mpt/database"
+	"fmt"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/ethereum/go-ethereum/trie"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func newEmpty() *Mpt {
+	mpt, _ := New(common.Hash{})
+	return mpt
+}
+
+func TestEmptyTrie(t *testing.T) {
+	mpt := newEmpty()
+	if root := mpt.Hash(); root != EmptyRoot {
+		t.Errorf("expected %x got %x", EmptyRoot, root)
+	}
+}
+
+// 直接用源码的测试例子
+func TestHashInsert(t *testing.T) {
+	mpt := newEmpty()
+	mpt.Insert([]byte("doe"), []byte("reindeer"))
+	mpt.Insert([]byte("dog"), []byte("puppy"))
+	mpt.Insert([]byte("dogglesworth"), []byte("cat"))
+
+	exp := common.HexToHash("8aad789dff2f538bca5d8ea56e8abe10f4c7ba3a5dea95fea4cd6e7c3a1168d3")
+	if root := mpt.Hash(); root != exp {
+		t.Errorf("case 1: exp %x got %x", exp, root)
+	}
+
+	mpt = newEmpty()
+	mpt.Insert([]byte("A"), []byte("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"))
+
+	exp = common.HexToHash("d23786fb4a010da3ce639d66d5e904a11dbc02746d1ce25029e53290cabf28ab")
+	if root := mpt.Hash(); root != exp {
+		t.Errorf("case 2: exp %x got %x", exp, root)
+	}
+}
+
+func TestHashDelete(t *testing.T) {
+	mpt := newEmpty()
+	vals := []struct{ k, v string }{
+		{"do", "verb"},
+		{"ether", "wookiedoo"},
+		{"horse", "stallion"},
+		{"shaman", "horse"},
+		{"doge", "coin"},
+		{"ether", ""},
+		{"dog", "puppy"},
+		{"shaman", ""},
+	}
+	for _, val := range vals {
+		if val.v != "" {
+			mpt.Insert([]byte(val.k), []byte(val.v))
+		} else {
+			mpt.Delete([]byte(val.k))
+		}
+	}
+
+	exp := common.HexToHash("5991bb8c6514148a29db676a14ac506cd2cd5775ace63c30a4fe457715e9ac84")
+	if hash := mpt.Hash(); hash != exp {
+		t.Errorf("expected %x got %x", exp, hash)
+	}
+
+	// 与源码一样，插入空value就是删除
+	mpt = newEmpty()
+	for _, val := range vals {
+		mpt.Insert([]byte(val.k), []byte(val.v))
+	}
+	if hash := mpt.Hash(); hash != exp {
+		t.Errorf("insert empty value: expected %x got %x", exp, hash)
+	}
+}
+
+// 随机插入/删除，结果与源码的trie比较
+func TestHashRandomAgainstGeth(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	for round := 0; round < 20; round++ {
+		mpt := newEmpty()
+		ref, _ := trie.New(common.Hash{}, trie.NewDatabase(memorydb.New()))
+
+		// key长度固定，变长key（一个key是另一个的前缀）的情况单独测试
+		keyLength := 1 + round%4
+		var keys [][]byte
+		for i := 0; i < 300; i++ {
+			var key []byte
+			if len(keys) > 0 && random.Intn(4) == 0 {
+				key = keys[random.Intn(len(keys))]
+			} else {
+				key = make([]byte, 8)
+				binary.BigEndian.PutUint64(key, uint64(random.Intn(1000)))
+				key = crypto.Keccak256(key)[:keyLength]
+				keys = append(keys, key)
+			}
+			if random.Intn(5) == 0 {
+				mpt.Delete(key)
+				ref.Delete(key)
+			} else {
+				value := make([]byte, 1+random.Intn(40))
+				random.Read(value)
+				mpt.Insert(key, value)
+				ref.Update(key, value)
+			}
+			if i%50 == 0 {
+				if have, want := mpt.Hash(), ref.Hash(); have != want {
+					t.Fatalf("round %d step %d: root mismatch, have %x want %x", round, i, have, want)
+				}
+			}
+		}
+		if have, want := mpt.Hash(), ref.Hash(); have != want {
+			t.Fatalf("round %d: root mismatch, have %x want %x", round, have, want)
+		}
+		for _, key := range keys {
+			have, _ := mpt.GetValue(key)
+			want, _ := ref.TryGet(key)
+			if !bytes.Equal(have, want) {
+				t.Fatalf("round %d: value mismatch for %x, have %x want %x", round, key, have, want)
+			}
+		}
+	}
+}
+
+func TestCommitAndReopen(t *testing.T) {
+	mpt := newEmpty()
+	random := rand.New(rand.NewSource(2))
+	vals := make(map[string][]byte)
+	for i := 0; i < 500; i++ {
+		key, value := make([]byte, 32), make([]byte, 1+random.Intn(64))
+		random.Read(key)
+		random.Read(value)
+		vals[string(key)] = value
+		mpt.Insert(key, value)
+	}
+	exp := mpt.Hash()
+	root, err := mpt.Commit()
+	if err != nil {
+		t.Fatalf("commit error: %v", err)
+	}
+	if root != exp {
+		t.Fatalf("commit root mismatch, have %x want %x", root, exp)
+	}
+	if _, ok := mpt.root.(hashedNode); !ok {
+		t.Fatalf("root should be collapsed into hashedNode after commit, got %T", mpt.root)
+	}
+	// 同一个数据库上重新打开
+	reopened, err := NewWithDatabase(root, mpt.Database())
+	if err != nil {
+		t.Fatalf("reopen error: %v", err)
+	}
+	for k, v := range vals {
+		have, err := reopened.GetValue([]byte(k))
+		if err != nil {
+			t.Fatalf("get error: %v", err)
+		}
+		if !bytes.Equal(have, v) {
+			t.Fatalf("value mismatch for %x, have %x want %x", k, have, v)
+		}
+	}
+	if hash := reopened.Hash(); hash != root {
+		t.Fatalf("reopened root mismatch, have %x want %x", hash, root)
+	}
+	// 提交后继续修改，再次提交
+	for k := range vals {
+		mpt.Delete([]byte(k))
+		delete(vals, k)
+		if len(vals) == 250 {
+			break
+		}
+	}
+	root, err = mpt.Commit()
+	if err != nil {
+		t.Fatalf("commit error: %v", err)
+	}
+	reopened, err = NewWithDatabase(root, mpt.Database())
+	if err != nil {
+		t.Fatalf("reopen error: %v", err)
+	}
+	for k, v := range vals {
+		if have, _ := reopened.GetValue([]byte(k)); !bytes.Equal(have, v) {
+			t.Fatalf("value mismatch for %x after second commit, have %x want %x", k, have, v)
+		}
+	}
+}
+
+func TestCommitEmbeddedNodes(t *testing.T) {
+	mpt := newEmpty()
+	// 短key短value，会产生嵌入节点
+	for i := byte(0); i < 20; i++ {
+		mpt.Insert([]byte{i, i}, []byte{i})
+	}
+	root, err := mpt.Commit()
+	if err != nil {
+		t.Fatalf("commit error: %v", err)
+	}
+	reopened, err := NewWithDatabase(root, mpt.Database())
+	if err != nil {
+		t.Fatalf("reopen error: %v", err)
+	}
+	for i := byte(0); i < 20; i++ {
+		if have, _ := reopened.GetValue([]byte{i, i}); !bytes.Equal(have, []byte{i}) {
+			t.Fatalf("value mismatch for %x, have %x", []byte{i, i}, have)
+		}
+	}
+}
+
+func TestSharedDatabase(t *testing.T) {
+	diskdb := database.NewMemoryDatabase()
+	db := NewDatabaseWithStore(diskdb)
+
+	// 两棵树共用同一个Database
+	a, _ := NewWithDatabase(common.Hash{}, db)
+	b, _ := NewWithDatabase(common.Hash{}, db)
+	a.Insert([]byte("alpha"), []byte("1"))
+	b.Insert([]byte("beta"), []byte("2"))
+	rootA, _ := a.Commit()
+	rootB, _ := b.Commit()
+	db.Commit(rootA)
+	db.Commit(rootB)
+
+	// 历史root：修改之后旧root依然可以打开
+	a.Insert([]byte("alpha"), []byte("3"))
+	newRootA, _ := a.Commit()
+	db.Commit(newRootA)
+
+	// 另一个Database包装同一个底层存储，同样可以读出来
+	other := NewDatabaseWithStore(diskdb)
+	tests := []struct {
+		root       common.Hash
+		key, value string
+	}{
+		{rootA, "alpha", "1"},
+		{rootB, "beta", "2"},
+		{newRootA, "alpha", "3"},
+	}
+	for _, test := range tests {
+		for _, db := range []*Database{db, other} {
+			mpt, err := NewWithDatabase(test.root, db)
+			if err != nil {
+				t.Fatalf("failed to open root %x: %v", test.root, err)
+			}
+			if have, _ := mpt.GetValue([]byte(test.key)); string(have) != test.value {
+				t.Errorf("root %x key %q: have %q want %q", test.root, test.key, have, test.value)
+			}
+		}
+	}
+	if _, err := New(rootA); err == nil {
+		t.Errorf("expected error when opening root %x in a private database", rootA)
+	}
+}
+
+func TestDereference(t *testing.T) {
+	diskdb := database.NewMemoryDatabase()
+	db := NewDatabaseWithStore(diskdb)
+	mpt, vals := randomTrie(200)
+	mpt.db = db
+	root1, _ := mpt.Commit()
+	db.Reference(root1, common.Hash{})
+	nodes1, size1 := db.Size()
+	if nodes1 == 0 || size1 == 0 {
+		t.Fatalf("expected committed nodes in memory, have %d nodes", nodes1)
+	}
+
+	// 修改一部分，新旧两个root共享没有修改的子树
+	var changed []string
+	for k := range vals {
+		vals[k] = []byte("changed")
+		mpt.Insert([]byte(k), vals[k])
+		if changed = append(changed, k); len(changed) == 10 {
+			break
+		}
+	}
+	root2, _ := mpt.Commit()
+	db.Reference(root2, common.Hash{})
+	nodes2, _ := db.Size()
+
+	// 旧root被丢弃，只属于它的节点从内存中删除，不会落盘
+	db.Dereference(root1)
+	nodes3, _ := db.Size()
+	if nodes3 >= nodes2 || nodes3 <= nodes2-nodes1 {
+		t.Fatalf("unexpected node count after dereference: %d (before %d, old trie %d)", nodes3, nodes2, nodes1)
+	}
+	if _, err := NewWithDatabase(root1, db); err == nil {
+		t.Fatalf("expected dereferenced root %x to be gone", root1)
+	}
+	reopened, err := NewWithDatabase(root2, db)
+	if err != nil {
+		t.Fatalf("failed to open root %x: %v", root2, err)
+	}
+	for k, v := range vals {
+		if have, _ := reopened.GetValue([]byte(k)); !bytes.Equal(have, v) {
+			t.Fatalf("key %x: have %x want %x", k, have, v)
+		}
+	}
+
+	// 落盘之后dirties清空，底层存储中只有新root的节点
+	if err := db.Commit(root2); err != nil {
+		t.Fatalf("commit error: %v", err)
+	}
+	if nodes, size := db.Size(); nodes != 0 || size != 0 {
+		t.Fatalf("expected empty dirty cache after commit, have %d nodes, %v", nodes, size)
+	}
+	if ok, _ := diskdb.Has(root1[:]); ok {
+		t.Errorf("dereferenced root %x reached disk", root1)
+	}
+	reopened, err = NewWithDatabase(root2, NewDatabaseWithStore(diskdb))
+	if err != nil {
+		t.Fatalf("failed to open root %x from disk: %v", root2, err)
+	}
+	for k, v := range vals {
+		if have, _ := reopened.GetValue([]byte(k)); !bytes.Equal(have, v) {
+			t.Fatalf("key %x on disk: have %x want %x", k, have, v)
+		}
+	}
+}
+
+func TestCleanCache(t *testing.T) {
+	src, vals := randomTrie(200)
+	root, _ := src.Commit()
+	src.Database().Commit(root)
+	// 包装同一个底层存储，缓存从空开始
+	db := NewDatabaseWithConfig(src.Database().DiskDB(), &Config{Cache: 1})
+
+	read := func() {
+		mpt, err := NewWithDatabase(root, db)
+		if err != nil {
+			t.Fatalf("failed to open root %x: %v", root, err)
+		}
+		for k, v := range vals {
+			if have, _ := mpt.GetValue([]byte(k)); !bytes.Equal(have, v) {
+				t.Fatalf("key %x: have %x want %x", k, have, v)
+			}
+		}
+	}
+	read()
+	first := db.CacheStats()
+	if first.Misses == 0 || first.Bytes == 0 {
+		t.Fatalf("expected misses on a cold cache, got %+v", first)
+	}
+	// 第二棵树读同样的数据，全部命中
+	read()
+	second := db.CacheStats()
+	if second.Misses != first.Misses {
+		t.Errorf("expected no new misses, have %d want %d", second.Misses, first.Misses)
+	}
+	if second.Hits <= first.Hits {
+		t.Errorf("expected new hits, have %d want > %d", second.Hits, first.Hits)
+	}
+
+	// 新提交的节点在dirties中，不会到diskdb中取
+	mpt, _ := NewWithDatabase(root, db)
+	mpt.Insert([]byte("fresh"), []byte("node"))
+	newRoot, _ := mpt.Commit()
+	before := db.CacheStats()
+	reopened, _ := NewWithDatabase(newRoot, db)
+	if have, _ := reopened.GetValue([]byte("fresh")); string(have) != "node" {
+		t.Errorf("have %q want %q", have, "node")
+	}
+	if after := db.CacheStats(); after.Misses != before.Misses {
+		t.Errorf("expected committed nodes to be served from memory, misses %d -> %d", before.Misses, after.Misses)
+	}
+
+	if stats := NewDatabase().CacheStats(); stats != (CacheStats{}) {
+		t.Errorf("expected empty stats without cache, got %+v", stats)
+	}
+}
+
+func TestGetNode(t *testing.T) {
+	random := rand.New(rand.NewSource(3))
+	mpt := newEmpty()
+	refdb := trie.NewDatabase(memorydb.New())
+	ref, _ := trie.New(common.Hash{}, refdb)
+
+	var keys [][]byte
+	for i := 0; i < 200; i++ {
+		key, value := make([]byte, 32), make([]byte, 32)
+		random.Read(key)
+		random.Read(value)
+		keys = append(keys, key)
+		mpt.Insert(key, value)
+		ref.Update(key, value)
+	}
+	// 未提交时，内存中的节点编码应当与数据库中的一致
+	memory := newEmpty()
+	for _, key := range keys {
+		value, _ := mpt.GetValue(key)
+		memory.Insert(key, value)
+	}
+	root, _ := mpt.Commit()
+	refRoot, _ := ref.Commit(nil)
+	refdb.Commit(refRoot, false, nil)
+	if root != refRoot {
+		t.Fatalf("root mismatch, have %x want %x", root, refRoot)
+	}
+
+	reopened, _ := NewWithDatabase(root, mpt.Database())
+	blob, resolved, err := reopened.GetNode(nil)
+	if err != nil || resolved != 0 {
+		t.Fatalf("root node: unexpected resolved %d, err %v", resolved, err)
+	}
+	if hash := crypto.Keccak256Hash(blob); hash != root {
+		t.Fatalf("root node hash mismatch, have %x want %x", hash, root)
+	}
+
+	for _, key := range keys[:50] {
+		path := key2hex(key)
+		for i := 0; i <= len(path); i++ {
+			hpe := hex2hpe(path[:i])
+			// 每次重新打开：源码对已展开的节点直接编码，不会折叠子节点
+			reopened, _ := NewWithDatabase(root, mpt.Database())
+			refReopened, _ := trie.New(refRoot, refdb)
+			want, wantResolved, err := refReopened.TryGetNode(hpe)
+			if err != nil {
+				continue // 源码中嵌入节点会报错
+			}
+			have, haveResolved, err := reopened.GetNode(hpe)
+			if err != nil {
+				t.Fatalf("path %x: unexpected error %v", path[:i], err)
+			}
+			if !bytes.Equal(have, want) || haveResolved != wantResolved {
+				t.Fatalf("path %x: have %x (resolved %d), want %x (resolved %d)", path[:i], have, haveResolved, want, wantResolved)
+			}
+			fromMemory, _, _ := memory.GetNode(hpe)
+			if !bytes.Equal(fromMemory, want) {
+				t.Fatalf("path %x: in-memory encoding %x, want %x", path[:i], fromMemory, want)
+			}
+		}
+	}
+}
+
+func TestMissingRoot(t *testing.T) {
+	root := common.HexToHash("0beec7b5ea3f0fdbc95d0dd47f3c5bc275da8a33")
+	mpt, err := New(root)
+	if mpt != nil {
+		t.Error("New returned non-nil trie for invalid root")
+	}
+	if missing, ok := err.(*MissingNodeError); !ok || missing.NodeHash != root {
+		t.Errorf("New returned wrong error: %v", err)
+	}
+}
+
+// 构造一棵提交过的树，返回根哈希、底层存储，以及一个位于第二层的节点的哈希和路径
+func committedTrieWithInnerNode(t *testing.T) (common.Hash, *database.MemoryDatabase, common.Hash, []byte) {
+	diskdb := database.NewMemoryDatabase()
+	mpt, _ := NewWithDatabase(common.Hash{}, NewDatabaseWithStore(diskdb))
+	for i := 0; i < 256; i++ {
+		key := crypto.Keccak256([]byte{byte(i)})
+		mpt.Insert(key, key)
+	}
+	root, _ := mpt.Commit()
+	mpt.Database().Commit(root)
+
+	reopened, _ := NewWithDatabase(root, mpt.Database())
+	for it := reopened.NodeIterator(nil); it.Next(true); {
+		if len(it.Path()) == 1 && it.Hash() != (common.Hash{}) {
+			return root, diskdb, it.Hash(), common.CopyBytes(it.Path())
+		}
+	}
+	t.Fatalf("no inner node found")
+	return common.Hash{}, nil, common.Hash{}, nil
+}
+
+// 数据库本身出错时不是MissingNodeError，底层的error要带出来
+func TestNodeReadError(t *testing.T) {
+	root, diskdb, _, _ := committedTrieWithInnerNode(t)
+	mpt, _ := NewWithDatabase(root, NewDatabaseWithStore(diskdb))
+	diskdb.Close()
+	_, err := mpt.GetValue(crypto.Keccak256([]byte{0}))
+	if err == nil {
+		t.Fatalf("no error from closed database")
+	}
+	if _, ok := err.(*MissingNodeError); ok {
+		t.Fatalf("read error reported as missing node: %v", err)
+	}
+	if !strings.HasPrefix(err.Error(), "failed to read trie node") || !strings.Contains(err.Error(), "database closed") {
+		t.Fatalf("error lacks cause or hash: %v", err)
+	}
+	if result := Verify(diskdb, root); len(result.Violations) != 1 || !strings.HasPrefix(result.Violations[0].Reason, "unreadable node") {
+		t.Fatalf("unexpected violations: %v", result.Violations)
+	}
+}
+
+func TestMissingNode(t *testing.T) {
+	root, diskdb, hash, path := committedTrieWithInnerNode(t)
+	diskdb.Delete(hash[:])
+
+	// 路径经过缺失节点的key
+	var key []byte
+	for i := 0; i < 256; i++ {
+		if k := crypto.Keccak256([]byte{byte(i)}); k[0]>>4 == path[0] {
+			key = k
+			break
+		}
+	}
+	check := func(op string, err error) {
+		missing, ok := err.(*MissingNodeError)
+		if !ok {
+			t.Fatalf("%s: expected MissingNodeError, got %v", op, err)
+		}
+		if missing.NodeHash != hash || !bytes.Equal(missing.Path, path) {
+			t.Fatalf("%s: wrong error content: %v (want hash %x path %x)", op, missing, hash, path)
+		}
+	}
+	db := NewDatabaseWithStore(diskdb)
+	mpt, _ := NewWithDatabase(root, db)
+	_, err := mpt.GetValue(key)
+	check("get", err)
+
+	mpt, _ = NewWithDatabase(root, db)
+	check("insert", mpt.Insert(key, []byte("value")))
+
+	mpt, _ = NewWithDatabase(root, db)
+	check("delete", mpt.Delete(key))
+
+	mpt, _ = NewWithDatabase(root, db)
+	check("prove", mpt.Prove(key, database.NewMemoryDatabase()))
+
+	// 不经过缺失节点的key不受影响
+	mpt, _ = NewWithDatabase(root, db)
+	other := crypto.Keccak256([]byte{0})
+	if other[0]>>4 != path[0] {
+		if value, err := mpt.GetValue(other); err != nil || !bytes.Equal(value, other) {
+			t.Fatalf("unexpected result for unaffected key: %x, %v", value, err)
+		}
+	}
+}
+
+func TestCorruptNode(t *testing.T) {
+	root, diskdb, hash, path := committedTrieWithInnerNode(t)
+	blob := []byte{0xc3, 0x01, 0x02, 0x03}
+	diskdb.Put(hash[:], blob)
+
+	db := NewDatabaseWithStore(diskdb)
+	mpt, _ := NewWithDatabase(root, db)
+	it := mpt.NodeIterator(nil)
+	for it.Next(true) {
+	}
+	corrupt, ok := it.Error().(*CorruptNodeError)
+	if !ok {
+		t.Fatalf("expected CorruptNodeError, got %v", it.Error())
+	}
+	if corrupt.NodeHash != hash || !bytes.Equal(corrupt.Path, path) || !bytes.Equal(corrupt.Blob, blob) {
+		t.Fatalf("wrong error content: %v", corrupt)
+	}
+	if _, err := db.resolveHash(hash); err == nil {
+		t.Fatalf("expected error when resolving corrupt node")
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	mpt := newEmpty()
+	mpt.Insert([]byte("doe"), []byte("reindeer"))
+	root0 := mpt.Hash()
+
+	id1 := mpt.Snapshot()
+	mpt.Insert([]byte("dog"), []byte("puppy"))
+	mpt.Insert([]byte("dogglesworth"), []byte("cat"))
+	root1 := mpt.Hash()
+
+	id2 := mpt.Snapshot()
+	mpt.Delete([]byte("dog"))
+	mpt.Insert([]byte("doe"), []byte("changed"))
+	if _, err := mpt.Commit(); err != nil {
+		t.Fatalf("commit error: %v", err)
+	}
+	id3 := mpt.Snapshot()
+	mpt.Insert([]byte("horse"), []byte("stallion"))
+
+	mpt.RevertToSnapshot(id3)
+	if have, _ := mpt.GetValue([]byte("horse")); have != nil {
+		t.Errorf("expected horse to be reverted, have %q", have)
+	}
+	mpt.RevertToSnapshot(id2)
+	if hash := mpt.Hash(); hash != root1 {
+		t.Errorf("revert to %d: have %x want %x", id2, hash, root1)
+	}
+	if have, _ := mpt.GetValue([]byte("dog")); string(have) != "puppy" {
+		t.Errorf("have %q want %q", have, "puppy")
+	}
+	mpt.RevertToSnapshot(id1)
+	if hash := mpt.Hash(); hash != root0 {
+		t.Errorf("revert to %d: have %x want %x", id1, hash, root0)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected panic when reverting to an invalidated snapshot")
+		}
+	}()
+	mpt.RevertToSnapshot(id2)
+}
+
+// 回滚只换根节点，不需要读数据库
+func TestSnapshotWithoutDatabase(t *testing.T) {
+	diskdb := database.NewMemoryDatabase()
+	src, vals := randomTrie(200)
+	src.db = NewDatabaseWithStore(diskdb)
+	root, _ := src.Commit()
+	src.Database().Commit(root)
+
+	mpt, _ := NewWithDatabase(root, NewDatabaseWithStore(diskdb))
+	id := mpt.Snapshot()
+	for k := range vals {
+		mpt.Insert([]byte(k), []byte("changed"))
+	}
+	// 清空底层存储
+	it := diskdb.NewIterator(nil, nil)
+	for it.Next() {
+		diskdb.Delete(it.Key())
+	}
+	it.Release()
+
+	mpt.RevertToSnapshot(id)
+	if hash := mpt.Hash(); hash != root {
+		t.Errorf("have %x want %x", hash, root)
+	}
+}
+
+func TestCopy(t *testing.T) {
+	orig, vals := randomTrie(200)
+	root, _ := orig.Commit()
+	orig, _ = NewWithDatabase(root, orig.Database())
+
+	cpy := orig.Copy()
+	orig.Insert([]byte("orig"), []byte("1"))
+	cpy.Insert([]byte("copy"), []byte("2"))
+	if have, _ := orig.GetValue([]byte("copy")); have != nil {
+		t.Errorf("copy's change visible in original: %q", have)
+	}
+	if have, _ := cpy.GetValue([]byte("orig")); have != nil {
+		t.Errorf("original's change visible in copy: %q", have)
+	}
+	orig.Delete([]byte("orig"))
+	if hash := orig.Hash(); hash != root {
+		t.Errorf("original root changed: have %x want %x", hash, root)
+	}
+
+	// 并发读：每个goroutine一份副本，各自解析节点、计算哈希
+	base := cpy.Copy()
+	want := base.Hash()
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		go func(mpt *Mpt) {
+			for k, v := range vals {
+				if have, err := mpt.GetValue([]byte(k)); err != nil || !bytes.Equal(have, v) {
+					errs <- fmt.Errorf("key %x: have %x (%v) want %x", k, have, err, v)
+					return
+				}
+			}
+			if hash := mpt.Hash(); hash != want {
+				errs <- fmt.Errorf("root mismatch: have %x want %x", hash, want)
+				return
+			}
+			errs <- nil
+		}(base.Copy())
+	}
+	for i := 0; i < 8; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+// 批量修改的结果与源码的trie逐个修改一致，覆盖重复key、删除不存在的key、从已提交的树开始等情况
+func TestUpdateBatch(t *testing.T) {
+	random := rand.New(rand.NewSource(4))
+	for round := 0; round < 30; round++ {
+		mpt := newEmpty()
+		ref, _ := trie.New(common.Hash{}, trie.NewDatabase(memorydb.New()))
+		keyLength := 1 + round%4
+		var pool [][]byte
+		for i := 0; i < 200; i++ {
+			key := make([]byte, 8)
+			binary.BigEndian.PutUint64(key, uint64(random.Intn(500)))
+			pool = append(pool, crypto.Keccak256(key)[:keyLength])
+		}
+		if round%2 == 1 {
+			root, _ := mpt.Commit()
+			mpt, _ = NewWithDatabase(root, mpt.Database())
+		}
+		for batch := 0; batch < 5; batch++ {
+			n := random.Intn(100)
+			keys, values := make([][]byte, n), make([][]byte, n)
+			for i := 0; i < n; i++ {
+				keys[i] = pool[random.Intn(len(pool))]
+				if random.Intn(4) != 0 {
+					values[i] = make([]byte, 1+random.Intn(40))
+					random.Read(values[i])
+				}
+				if len(values[i]) == 0 {
+					ref.Delete(keys[i])
+				} else {
+					ref.Update(keys[i], values[i])
+				}
+			}
+			if err := mpt.UpdateBatch(keys, values); err != nil {
+				t.Fatalf("round %d batch %d: %v", round, batch, err)
+			}
+			if have, want := mpt.Hash(), ref.Hash(); have != want {
+				t.Fatalf("round %d batch %d: root mismatch, have %x want %x", round, batch, have, want)
+			}
+			if round%2 == 1 {
+				root, _ := mpt.Commit()
+				mpt, _ = NewWithDatabase(root, mpt.Database())
+			}
+		}
+		for _, key := range pool {
+			have, _ := mpt.GetValue(key)
+			want, _ := ref.TryGet(key)
+			if !bytes.Equal(have, want) {
+				t.Fatalf("round %d: value mismatch for %x, have %x want %x", round, key, have, want)
+			}
+		}
+	}
+	if err := newEmpty().UpdateBatch([][]byte{{1}}, nil); err != errBatchLength {
+		t.Errorf("expected %v, got %v", errBatchLength, err)
+	}
+}
+
+func BenchmarkUpdateBatch(b *testing.B) {
+	keys, values := make([][]byte, 10000), make([][]byte, 10000)
+	for i := range keys {
+		keys[i] = crypto.Keccak256([]byte{byte(i), byte(i >> 8)})
+		values[i] = keys[i]
+	}
+	b.Run("insert", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			mpt := newEmpty()
+			for j := range keys {
+				mpt.Insert(keys[j], values[j])
+			}
+		}
+	})
+	b.Run("batch", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			mpt := newEmpty()
+			mpt.UpdateBatch(keys, values)
+		}
+	})
+}
+
+// 一个key是另一个key的前缀：值放在branchNode.Children[16]中；空key也是合法的key
+func TestPrefixKeys(t *testing.T) {
+	vectors := []struct {
+		ops []struct{ k, v string } // v为空表示删除
+	}{
+		{ops: []struct{ k, v string }{{"do", "verb"}, {"dog", "puppy"}, {"doge", "coin"}, {"horse", "stallion"}}},
+		{ops: []struct{ k, v string }{{"dog", "puppy"}, {"do", "verb"}, {"doge", "coin"}, {"do", ""}}},
+		{ops: []struct{ k, v string }{{"do", "verb"}, {"dog", "puppy"}, {"dog", ""}}},
+		{ops: []struct{ k, v string }{{"do", "verb"}, {"dog", "puppy"}, {"dogs", "puppies"}, {"dog", ""}, {"do", ""}}},
+		{ops: []struct{ k, v string }{{"", "empty"}}},
+		{ops: []struct{ k, v string }{{"", "empty"}, {"a", "1"}, {"ab", "2"}}},
+		{ops: []struct{ k, v string }{{"a", "1"}, {"", "empty"}, {"a", ""}}},
+		{ops: []struct{ k, v string }{{"a", "1"}, {"", "empty"}, {"", ""}}},
+		{ops: []struct{ k, v string }{{"\x01", "1"}, {"\x01\x02", "2"}, {"\x01\x02\x03", "3"}, {"\x01\x02", ""}, {"\x01", ""}}},
+	}
+	for i, vector := range vectors {
+		mpt := newEmpty()
+		ref, _ := trie.New(common.Hash{}, trie.NewDatabase(memorydb.New()))
+		vals := make(map[string]string)
+		for _, op := range vector.ops {
+			if op.v == "" {
+				mpt.Delete([]byte(op.k))
+				ref.Delete([]byte(op.k))
+				delete(vals, op.k)
+			} else {
+				mpt.Insert([]byte(op.k), []byte(op.v))
+				ref.Update([]byte(op.k), []byte(op.v))
+				vals[op.k] = op.v
+			}
+		}
+		root := mpt.Hash()
+		if want := ref.Hash(); root != want {
+			t.Fatalf("vector %d: root mismatch, have %x want %x", i, root, want)
+		}
+		committed, _ := mpt.Commit()
+		reopened, err := NewWithDatabase(committed, mpt.Database())
+		if err != nil {
+			t.Fatalf("vector %d: reopen error: %v", i, err)
+		}
+		for _, mpt := range []*Mpt{mpt, reopened} {
+			for k, v := range vals {
+				if have, err := mpt.GetValue([]byte(k)); err != nil || string(have) != v {
+					t.Fatalf("vector %d: key %q: have %q (%v) want %q", i, k, have, err, v)
+				}
+			}
+			// 树中key的前缀、以及以树中key为前缀的key都查不到
+			for _, k := range []string{"d", "dogecoin", "\x01\x02\x03\x04", "abc"} {
+				if _, ok := vals[k]; ok {
+					continue
+				}
+				if have, err := mpt.GetValue([]byte(k)); err != nil || have != nil {
+					t.Fatalf("vector %d: unexpected result for %q: %q, %v", i, k, have, err)
+				}
+			}
+		}
+		if hash := reopened.Hash(); hash != root {
+			t.Fatalf("vector %d: reopened root mismatch, have %x want %x", i, hash, root)
+		}
+		// 从解码出的树上删除，同样与源码一致
+		for k := range vals {
+			reopened.Delete([]byte(k))
+			ref.Delete([]byte(k))
+			if have, want := reopened.Hash(), ref.Hash(); have != want {
+				t.Fatalf("vector %d: root mismatch after deleting %q, have %x want %x", i, k, have, want)
+			}
+		}
+		if hash := reopened.Hash(); hash != EmptyRoot {
+			t.Fatalf("vector %d: expected empty trie, got %x", i, hash)
+		}
+	}
+}
+
+// 变长key（大量互为前缀）随机插入/删除，结果与源码的trie比较，并且提交后可以完整读回
+func TestPrefixKeysRandom(t *testing.T) {
+	random := rand.New(rand.NewSource(5))
+	for round := 0; round < 20; round++ {
+		mpt := newEmpty()
+		ref, _ := trie.New(common.Hash{}, trie.NewDatabase(memorydb.New()))
+		var keys [][]byte
+		for i := 0; i < 300; i++ {
+			// 字母表很小，长度0~4，前缀关系非常多
+			key := make([]byte, random.Intn(5))
+			for j := range key {
+				key[j] = byte(random.Intn(3)) * 0x11
+			}
+			keys = append(keys, key)
+			if random.Intn(4) == 0 {
+				mpt.Delete(key)
+				ref.Delete(key)
+			} else {
+				value := make([]byte, 1+random.Intn(40))
+				random.Read(value)
+				mpt.Insert(key, value)
+				ref.Update(key, value)
+			}
+			if i%20 == 0 && round%2 == 1 {
+				root, err := mpt.Commit()
+				if err != nil {
+					t.Fatalf("round %d step %d: commit error: %v", round, i, err)
+				}
+				if mpt, err = NewWithDatabase(root, mpt.Database()); err != nil {
+					t.Fatalf("round %d step %d: reopen error: %v", round, i, err)
+				}
+			}
+		}
+		if have, want := mpt.Hash(), ref.Hash(); have != want {
+			t.Fatalf("round %d: root mismatch, have %x want %x", round, have, want)
+		}
+		for _, key := range keys {
+			have, err := mpt.GetValue(key)
+			want, _ := ref.TryGet(key)
+			if err != nil || !bytes.Equal(have, want) {
+				t.Fatalf("round %d: value mismatch for %x, have %x (%v) want %x", round, key, have, err, want)
+			}
+			proof := database.NewMemoryDatabase()
+			if err := mpt.Prove(key, proof); err != nil {
+				t.Fatalf("round %d: prove error for %x: %v", round, key, err)
+			}
+			if value, err := VerifyProof(mpt.Hash(), key, proof); err != nil || !bytes.Equal(value, want) {
+				t.Fatalf("round %d: verified value mismatch for %x, have %x (%v) want %x", round, key, value, err, want)
+			}
+		}
+		// 批量删除一半的key，结果同样一致
+		var batch [][]byte
+		for i, key := range keys {
+			if i%2 == 0 {
+				batch = append(batch, key)
+				ref.Delete(key)
+			}
+		}
+		if err := mpt.UpdateBatch(batch, make([][]byte, len(batch))); err != nil {
+			t.Fatalf("round %d: batch error: %v", round, err)
+		}
+		if have, want := mpt.Hash(), ref.Hash(); have != want {
+			t.Fatalf("round %d: root mismatch after batch, have %x want %x", round, have, want)
+		}
+		// 在空树上批量插入所有的key
+		fresh, values := newEmpty(), make([][]byte, len(keys))
+		for i, key := range keys {
+			values[i], _ = ref.TryGet(key)
+		}
+		if err := fresh.UpdateBatch(keys, values); err != nil {
+			t.Fatalf("round %d: batch error: %v", round, err)
+		}
+		if have, want := fresh.Hash(), ref.Hash(); have != want {
+			t.Fatalf("round %d: root mismatch after batch insert, have %x want %x", round, have, want)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package mpt
+
+import (
+	"bytes"
+	"ethereum-practice/rlp"
+	"fmt"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+/**
+完整性检查：从root出发遍历底层存储中所有可达的节点，检查数据库是否完整、格式是否正确
+对每个存储的节点（keccak(rlp) -> rlp）检查：
+	1.节点存在
+	2.内容的keccak等于key
+	3.decodeNode能正常解码，并且重新编码之后与原内容完全相同（规范编码）
+	4.除根节点外，编码不小于32byte（否则应该嵌入父节点中）
+对每个节点（包括嵌入节点）检查结构：
+	1.shortNode的子节点不能是shortNode（两段key应该合并）
+	2.拓展节点的key不能为空，必须有子节点；叶子节点的value不能为空
+	3.branchNode至少有两项（子节点或value），否则应该收缩成shortNode
+	4.嵌入节点的编码小于32byte
+发现问题不会停止，而是记录下来继续检查其它部分，最后一起返回；节点缺失或无法解码时才跳过其下的子树
+同一个哈希的子树只检查一次（内容相同，结果也相同），这也保证了key被篡改成环时不会死循环
+*/
+
+// 一处问题，Path是问题节点的hex路径，Hash是它所在的存储节点（嵌入节点所在的父节点）
+type Violation struct {
+	Path   []byte
+	Hash   common.Hash
+	Reason string
+}
+
+func (v *Violation) String() string {
+	return fmt.Sprintf("path %x (node %x): %s", v.Path, v.Hash, v.Reason)
+}
+
+type VerifyResult struct {
+	Nodes      uint64 // 检查过的存储节点数
+	Embedded   uint64 // 检查过的嵌入节点数
+	Bytes      uint64 // 存储节点编码的总字节数
+	Violations []*Violation
+}
+
+type verifier struct {
+	store   KeyValueReader
+	hasher  *hasher
+	tmp     sliceBuffer
+	visited map[common.Hash]bool // 检查过的存储节点 -> 是否为shortNode
+	result  VerifyResult
+}
+
+// 检查root下的整棵树，空root（EmptyRoot或空哈希）没有任何节点
+// 读取直接走底层存储，检查的是已经落盘的数据；Database中还没有Commit的节点不在检查范围内
+func Verify(store KeyValueReader, root common.Hash) VerifyResult {
+	if root == (common.Hash{}) || root == EmptyRoot {
+		return VerifyResult{}
+	}
+	v := &verifier{
+		store:   store,
+		hasher:  newHasher(false),
+		visited: make(map[common.Hash]bool),
+	}
+	defer returnHasherToPool(v.hasher)
+	v.verifyStored(root, nil, true)
+	return v.result
+}
+
+func (v *verifier) report(path []byte, hash common.Hash, format string, args ...interface{}) {
+	v.result.Violations = append(v.result.Violations, &Violation{
+		Path:   common.CopyBytes(path),
+		Hash:   hash,
+		Reason: fmt.Sprintf(format, args...),
+	})
+}
+
+// 编码折叠之后的节点，返回的切片在下次调用前有效
+func (v *verifier) encode(n node) []byte {
+	collapsed, _ := v.hasher.proofHash(n)
+	v.tmp.Reset()
+	if err := rlp.Encode(&v.tmp, collapsed); err != nil {
+		panic(fmt.Sprintf("encode error: %v", err))
+	}
+	return v.tmp
+}
+
+// 检查一个存储的节点，返回它是否为shortNode（父节点据此检查shortNode的嵌套）
+func (v *verifier) verifyStored(hash common.Hash, path []byte, isRoot bool) bool {
+	if short, ok := v.visited[hash]; ok {
+		return short
+	}
+	v.visited[hash] = false
+	blob, err := v.store.Get(hash[:])
+	if err != nil {
+		// 与Database.node相同，用Has区分节点不存在和读取出错
+		if has, herr := v.store.Has(hash[:]); herr != nil || has {
+			v.report(path, hash, "unreadable node: %v", err)
+			return false
+		}
+	}
+	if len(blob) == 0 {
+		v.report(path, hash, "missing node")
+		return false
+	}
+	v.result.Nodes++
+	v.result.Bytes += uint64(len(blob))
+	if have := crypto.Keccak256Hash(blob); have != hash {
+		v.report(path, hash, "hash mismatch, content hashes to %x", have)
+	}
+	n, err := decodeNode(hash[:], blob)
+	if err != nil {
+		v.report(path, hash, "undecodable node: %v", err)
+		return false
+	}
+	if !isRoot && len(blob) < common.HashLength {
+		v.report(path, hash, "stored node is %d bytes, should be embedded in its parent", len(blob))
+	}
+	if encoded := v.encode(n); !bytes.Equal(encoded, blob) {
+		v.report(path, hash, "non-canonical encoding, re-encodes to %x", encoded)
+	}
+	_, short := n.(*shortNode)
+	v.visited[hash] = short
+	v.verifyNode(n, hash, path)
+	return short
+}
+
+// 检查子节点，stored是子节点所在的存储节点；返回子节点是否为shortNode
+func (v *verifier) verifyChild(child node, stored common.Hash, path []byte) bool {
+	switch child := child.(type) {
+	case hashedNode:
+		return v.verifyStored(common.BytesToHash(child), path, false)
+	case *shortNode, *branchNode:
+		v.result.Embedded++
+		if size := len(v.encode(child)); size >= common.HashLength {
+			v.report(path, stored, "embedded node is %d bytes, must be under %d", size, common.HashLength)
+		}
+		v.verifyNode(child, stored, path)
+		_, short := child.(*shortNode)
+		return short
+	default:
+		v.report(path, stored, "unexpected child type %T", child)
+		return false
+	}
+}
+
+// 检查节点本身的结构，再递归检查子节点
+func (v *verifier) verifyNode(n node, stored common.Hash, path []byte) {
+	switch n := n.(type) {
+	case *shortNode:
+		if isLeaf(n.Key) {
+			if value, _ := n.Value.(valueNode); len(value) == 0 {
+				v.report(path, stored, "leaf %x has an empty value", n.Key)
+			}
+			return
+		}
+		if len(n.Key) == 0 {
+			v.report(path, stored, "extension node with an empty key")
+		}
+		if n.Value == nil {
+			v.report(path, stored, "extension node %x without child", n.Key)
+			return
+		}
+		childPath := concat(path, n.Key)
+		if v.verifyChild(n.Value, stored, childPath) {
+			v.report(path, stored, "extension node %x has a shortNode child, keys should be merged", n.Key)
+		}
+	case *branchNode:
+		count := 0
+		for _, child := range &n.Children {
+			if child != nil {
+				count++
+			}
+		}
+		if count < 2 {
+			v.report(path, stored, "branch node with %d entries, should be collapsed", count)
+		}
+		for i := 0; i < 16; i++ {
+			if child := n.Children[i]; child != nil {
+				v.verifyChild(child, stored, concat(path, []byte{byte(i)}))
+			}
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package mpt
+
+import (
+	"bytes"
+	"ethereum-practice/mpt/database"
+	"ethereum-practice/rlp"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"strings"
+	"testing"
+)
+
+// 把root下的树提交并落盘，返回根哈希
+func commitToStore(t *testing.T, diskdb *database.MemoryDatabase, root node) common.Hash {
+	db := NewDatabaseWithStore(diskdb)
+	mpt, _ := NewWithDatabase(common.Hash{}, db)
+	mpt.root = root
+	hash, err := mpt.Commit()
+	if err != nil {
+		t.Fatalf("commit error: %v", err)
+	}
+	if err := db.Commit(hash); err != nil {
+		t.Fatalf("database commit error: %v", err)
+	}
+	return hash
+}
+
+// 直接写入一个编码好的节点
+func putRawNode(diskdb *database.MemoryDatabase, blob []byte) hashedNode {
+	hash := crypto.Keccak256(blob)
+	diskdb.Put(hash, blob)
+	return hash
+}
+
+func TestVerify(t *testing.T) {
+	diskdb := database.NewMemoryDatabase()
+	mpt, _ := randomTrie(500)
+	// key互为前缀，branchNode带value
+	mpt.Insert([]byte{1}, []byte("a"))
+	mpt.Insert([]byte{1, 2}, []byte("b"))
+	root := commitToStore(t, diskdb, mpt.root)
+
+	result := Verify(diskdb, root)
+	if len(result.Violations) != 0 {
+		t.Fatalf("valid trie reported violations: %v", result.Violations)
+	}
+	if count, size := storeSize(diskdb); result.Nodes != count || result.Bytes != size-32*count {
+		t.Errorf("stats mismatch: have %d nodes %d bytes, store has %d keys %d bytes", result.Nodes, result.Bytes, count, size)
+	}
+	if result.Embedded == 0 {
+		t.Errorf("no embedded nodes checked")
+	}
+	if result := Verify(diskdb, EmptyRoot); result.Nodes != 0 || len(result.Violations) != 0 {
+		t.Errorf("empty root: %+v", result)
+	}
+}
+
+func TestVerifyMissingRoot(t *testing.T) {
+	root := common.HexToHash("0x01")
+	result := Verify(database.NewMemoryDatabase(), root)
+	if len(result.Violations) != 1 || result.Violations[0].Hash != root || result.Violations[0].Reason != "missing node" {
+		t.Fatalf("unexpected violations: %v", result.Violations)
+	}
+}
+
+// 损坏几个互不包含的子树，每一处都要报告，并且带着正确的路径
+func TestVerifyCorruptStore(t *testing.T) {
+	diskdb := database.NewMemoryDatabase()
+	mpt, _ := randomTrie(500)
+	root := commitToStore(t, diskdb, mpt.root)
+
+	// 取根节点下三个不同子树中的存储节点
+	reopened, _ := NewWithDatabase(root, NewDatabaseWithStore(diskdb))
+	paths := make(map[common.Hash][]byte)
+	var picked []common.Hash
+	for it := reopened.NodeIterator(nil); it.Next(true) && len(picked) < 3; {
+		path := it.Path()
+		if hash := it.Hash(); hash != (common.Hash{}) && len(path) == 2 && path[0] == byte(len(picked)) {
+			paths[hash] = common.CopyBytes(path)
+			picked = append(picked, hash)
+		}
+	}
+	if len(picked) != 3 {
+		t.Fatalf("trie too small, picked %d nodes", len(picked))
+	}
+	missing, mismatch, garbage := picked[0], picked[1], picked[2]
+	diskdb.Delete(missing[:])
+	blob, _ := diskdb.Get(mismatch[:])
+	diskdb.Put(mismatch[:], append(blob, 0x80))
+	diskdb.Put(garbage[:], []byte{0x01, 0x02, 0x03})
+
+	want := []struct {
+		hash   common.Hash
+		reason string
+	}{
+		{missing, "missing node"},
+		{mismatch, "hash mismatch"},
+		{mismatch, "non-canonical encoding"},
+		{garbage, "hash mismatch"},
+		{garbage, "undecodable node"},
+	}
+	result := Verify(diskdb, root)
+	if len(result.Violations) != len(want) {
+		t.Fatalf("have %d violations, want %d: %v", len(result.Violations), len(want), result.Violations)
+	}
+	for i, w := range want {
+		v := result.Violations[i]
+		if v.Hash != w.hash || !bytes.Equal(v.Path, paths[w.hash]) || !strings.HasPrefix(v.Reason, w.reason) {
+			t.Errorf("violation %d: have %v, want %q at path %x", i, v, w.reason, paths[w.hash])
+		}
+	}
+}
+
+// 结构不合法的节点，Mpt本身不会产生这样的树，直接构造出来
+func TestVerifyStructure(t *testing.T) {
+	diskdb := database.NewMemoryDatabase()
+	long := bytes.Repeat([]byte{0xaa}, 40)
+
+	// 叶子节点[0x20, "ab"]只有5个字节，却单独存储
+	small := putRawNode(diskdb, []byte{0xc4, 0x20, 0x82, 'a', 'b'})
+	// branchNode中第5个子节点是恰好32字节的嵌入叶子节点，第6个是正常的嵌入节点
+	oversized, _ := rlp.EncodeToBytes([]interface{}{[]byte{0x20}, bytes.Repeat([]byte{0xbb}, 29)})
+	normal, _ := rlp.EncodeToBytes([]interface{}{[]byte{0x20}, []byte("c")})
+	children := make([]interface{}, 17)
+	for i := range children {
+		children[i] = rlp.RawValue{0x80}
+	}
+	children[5], children[6] = rlp.RawValue(oversized), rlp.RawValue(normal)
+	branchBlob, _ := rlp.EncodeToBytes(children)
+	crafted := putRawNode(diskdb, branchBlob)
+
+	root := &branchNode{status: nodeStatus{dirty: true}}
+	// shortNode下面是单独存储的shortNode
+	root.Children[0] = &shortNode{[]byte{1, 2}, &shortNode{[]byte{3, 4, 16}, valueNode(long), nodeStatus{dirty: true}}, nodeStatus{dirty: true}}
+	// 只有一个子节点的branchNode
+	single := &branchNode{status: nodeStatus{dirty: true}}
+	single.Children[3] = &shortNode{[]byte{5, 16}, valueNode(long), nodeStatus{dirty: true}}
+	root.Children[1] = single
+	// value为空的叶子
+	root.Children[2] = &shortNode{[]byte{7, 16}, valueNode{}, nodeStatus{dirty: true}}
+	root.Children[4] = small
+	root.Children[5] = crafted
+	// 嵌入的shortNode下面是嵌入的shortNode
+	root.Children[6] = &shortNode{[]byte{1}, &shortNode{[]byte{2, 16}, valueNode("x"), nodeStatus{dirty: true}}, nodeStatus{dirty: true}}
+	hash := commitToStore(t, diskdb, root)
+
+	want := []struct {
+		path   []byte
+		reason string
+	}{
+		{[]byte{0}, "extension node 0102 has a shortNode child"},
+		{[]byte{1}, "branch node with 1 entries"},
+		{[]byte{2}, "leaf 0710 has an empty value"},
+		{[]byte{4}, "stored node is 5 bytes"},
+		{[]byte{5}, "non-canonical encoding"},
+		{[]byte{5, 5}, "embedded node is 32 bytes"},
+		{[]byte{6}, "extension node 01 has a shortNode child"},
+	}
+	result := Verify(diskdb, hash)
+	if len(result.Violations) != len(want) {
+		t.Fatalf("have %d violations, want %d: %v", len(result.Violations), len(want), result.Violations)
+	}
+	for i, w := range want {
+		if v := result.Violations[i]; !bytes.Equal(v.Path, w.path) || !strings.HasPrefix(v.Reason, w.reason) {
+			t.Errorf("violation %d: have %v, want %q at path %x", i, v, w.reason, w.path)
+		}
+	}
+}